@@ -0,0 +1,108 @@
+/* Copyright (C) 2021 Nicolas Peugnet <n.peugnet@free.fr>
+
+   This file is part of dna-backup.
+
+   dna-backup is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   dna-backup is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with dna-backup.  If not, see <https://www.gnu.org/licenses/>. */
+
+package chunker
+
+import (
+	"fmt"
+	"math/bits"
+	"math/rand"
+)
+
+// Names of the available chunkers. As the chunks of a repo can only be matched
+// by the chunker that produced them, these names are stored in its config and
+// must never change.
+const (
+	FixedName   = "fixed"
+	FastCDCName = "fastcdc"
+)
+
+// Check returns an error if name is not the one of an available chunker.
+func Check(name string) error {
+	switch name {
+	case FixedName, FastCDCName:
+		return nil
+	default:
+		return fmt.Errorf("unknown chunker: %s", name)
+	}
+}
+
+// FastCDC is a content-defined chunker, following "FastCDC: a Fast and
+// Efficient Content-Defined Chunking Approach for Data Deduplication" (Xia et
+// al.). A chunk ends where the Gear hash of its last bytes matches a mask, so
+// that an insertion in the data only modifies the chunks around it.
+//
+// Normalized chunking is used: a stricter mask is used before the average size
+// and a looser one after it, which concentrates the chunk sizes around it.
+type FastCDC struct {
+	Min   int
+	Avg   int
+	Max   int
+	maskS uint64
+	maskL uint64
+	table [256]uint64
+}
+
+// NewFastCDC returns a FastCDC chunker producing chunks of sizes between min
+// and max, avg on average. Its Gear table is chosen using the given seed.
+func NewFastCDC(seed int64, min int, avg int, max int) *FastCDC {
+	// the high bits of the Gear hash depend on more bytes than the low ones
+	b := bits.Len(uint(avg)) - 1
+	c := &FastCDC{
+		Min:   min,
+		Avg:   avg,
+		Max:   max,
+		maskS: ^uint64(0) << (64 - b - 2),
+		maskL: ^uint64(0) << (64 - b + 2),
+	}
+	rand := rand.New(rand.NewSource(seed))
+	for i := range c.table {
+		c.table[i] = rand.Uint64()
+	}
+	return c
+}
+
+// Cut returns the length of the chunk at the start of data. data must hold at
+// least Max bytes, unless it is the end of the stream.
+func (c *FastCDC) Cut(data []byte) int {
+	n := len(data)
+	if n <= c.Min {
+		return n
+	}
+	if n > c.Max {
+		n = c.Max
+	}
+	normal := c.Avg
+	if normal > n {
+		normal = n
+	}
+	var h uint64
+	i := c.Min
+	for ; i < normal; i++ {
+		h = h<<1 + c.table[data[i]]
+		if h&c.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		h = h<<1 + c.table[data[i]]
+		if h&c.maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
@@ -0,0 +1,78 @@
+/* Copyright (C) 2021 Nicolas Peugnet <n.peugnet@free.fr>
+
+   This file is part of dna-backup.
+
+   dna-backup is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   dna-backup is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with dna-backup.  If not, see <https://www.gnu.org/licenses/>. */
+
+package chunker
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func split(c *FastCDC, data []byte) (chunks []string) {
+	for len(data) > 0 {
+		n := c.Cut(data)
+		chunks = append(chunks, string(data[:n]))
+		data = data[n:]
+	}
+	return
+}
+
+func TestFastCDC(t *testing.T) {
+	c := NewFastCDC(1, 2<<10, 8<<10, 32<<10)
+	rand := rand.New(rand.NewSource(1))
+	data := make([]byte, 1<<20)
+	rand.Read(data)
+	chunks := split(c, data)
+	for i, chunk := range chunks[:len(chunks)-1] {
+		if len(chunk) < c.Min || len(chunk) > c.Max {
+			t.Errorf("chunk %d has size %d, not in [%d, %d]", i, len(chunk), c.Min, c.Max)
+		}
+	}
+	avg := len(data) / len(chunks)
+	if avg < c.Avg/2 || avg > c.Avg*2 {
+		t.Errorf("average chunk size %d is too far from %d", avg, c.Avg)
+	}
+
+	// an insertion in the middle only modifies the chunks around it
+	inserted := make([]byte, 100)
+	rand.Read(inserted)
+	pos := len(data) / 2
+	modified := append(append(append([]byte{}, data[:pos]...), inserted...), data[pos:]...)
+	existing := make(map[string]bool)
+	for _, chunk := range chunks {
+		existing[chunk] = true
+	}
+	var changed int
+	for _, chunk := range split(c, modified) {
+		if !existing[chunk] {
+			changed++
+		}
+	}
+	if changed > 2 {
+		t.Errorf("%d chunks have changed after an insertion", changed)
+	}
+}
+
+func BenchmarkFastCDC(b *testing.B) {
+	c := NewFastCDC(1, 2<<10, 8<<10, 32<<10)
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		split(c, data)
+	}
+}
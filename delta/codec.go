@@ -0,0 +1,77 @@
+/* Copyright (C) 2021 Nicolas Peugnet <n.peugnet@free.fr>
+
+   This file is part of dna-backup.
+
+   dna-backup is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   dna-backup is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with dna-backup.  If not, see <https://www.gnu.org/licenses/>. */
+
+package delta
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// CodecId identifies the algorithm that produced a patch. It is stored along
+// the patch so that it can be applied even if the algorithm used to produce
+// new patches has changed since. These values must never change.
+type CodecId uint8
+
+const (
+	UnknownCodec CodecId = iota // patches stored before codecs were recorded
+	BsdiffCodec
+	FdeltaCodec
+	VcdiffCodec
+)
+
+// Codec is both a Differ and a Patcher.
+type Codec interface {
+	Differ
+	Patcher
+}
+
+var codecs = map[CodecId]Codec{
+	BsdiffCodec: Bsdiff{},
+	FdeltaCodec: Fdelta{},
+	VcdiffCodec: Vcdiff{},
+}
+
+// Register adds a codec to the registry with the given ID, which must not be
+// already used.
+func Register(id CodecId, codec Codec) {
+	if _, exists := codecs[id]; exists || id == UnknownCodec {
+		panic(fmt.Sprintf("delta codec id %d already registered", id))
+	}
+	codecs[id] = codec
+}
+
+// Lookup returns the codec registered with the given ID.
+func Lookup(id CodecId) (Codec, error) {
+	codec, exists := codecs[id]
+	if !exists {
+		return nil, fmt.Errorf("unknown delta codec id %d", id)
+	}
+	return codec, nil
+}
+
+// IdOf returns the ID of the registered codec of the same type as the given
+// Differ, or UnknownCodec if there is none.
+func IdOf(differ Differ) CodecId {
+	t := reflect.TypeOf(differ)
+	for id, codec := range codecs {
+		if reflect.TypeOf(codec) == t {
+			return id
+		}
+	}
+	return UnknownCodec
+}
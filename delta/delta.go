@@ -19,59 +19,79 @@ package delta
 
 import (
 	"fmt"
-	"io"
 
 	"github.com/gabstv/go-bsdiff/pkg/bsdiff"
 	"github.com/gabstv/go-bsdiff/pkg/bspatch"
 	"github.com/mdvan/fdelta"
 )
 
+// Differ produces patches.
+//
+// Diff appends to dst the patch that transforms source into target and returns
+// the extended buffer, like the append built-in does. This way callers can reuse
+// their buffers instead of allocating a new one for each patch.
 type Differ interface {
-	Diff(source io.Reader, target io.Reader, patch io.Writer) error
+	Diff(dst []byte, source []byte, target []byte) ([]byte, error)
 }
 
+// Patcher applies patches.
+//
+// Patch appends to dst the result of applying patch to source and returns the
+// extended buffer, like the append built-in does.
 type Patcher interface {
-	Patch(source io.Reader, target io.Writer, patch io.Reader) error
+	Patch(dst []byte, source []byte, patch []byte) ([]byte, error)
 }
 
-type Bsdiff struct{}
-
-func (Bsdiff) Diff(source io.Reader, target io.Reader, patch io.Writer) error {
-	return bsdiff.Reader(source, target, patch)
+// limitedPatcher is implemented by the patchers that can check the size of the
+// target before decoding it.
+type limitedPatcher interface {
+	patchLimit(dst []byte, source []byte, patch []byte, limit int) ([]byte, error)
 }
 
-func (Bsdiff) Patch(source io.Reader, target io.Writer, patch io.Reader) error {
-	return bspatch.Reader(source, target, patch)
+// PatchLimit is like the Patch method of p, but returns an error if the target
+// is larger than limit, the expected size of the target. Vcdiff checks it
+// before decoding the target, so that an invalid patch cannot make it allocate
+// more.
+func PatchLimit(p Patcher, dst []byte, source []byte, patch []byte, limit int) ([]byte, error) {
+	if l, ok := p.(limitedPatcher); ok {
+		return l.patchLimit(dst, source, patch, limit)
+	}
+	start := len(dst)
+	dst, err := p.Patch(dst, source, patch)
+	if err == nil && len(dst)-start > limit {
+		return dst, fmt.Errorf("patch target of %d bytes exceeds the expected size %d", len(dst)-start, limit)
+	}
+	return dst, err
 }
 
-type Fdelta struct{}
+type Bsdiff struct{}
 
-func (Fdelta) Diff(source io.Reader, target io.Reader, patch io.Writer) error {
-	sourceBuf, err := io.ReadAll(source)
-	if err != nil {
-		return err
-	}
-	targetBuf, err := io.ReadAll(target)
+func (Bsdiff) Diff(dst []byte, source []byte, target []byte) ([]byte, error) {
+	patch, err := bsdiff.Bytes(source, target)
 	if err != nil {
-		return err
+		return dst, err
 	}
-	_, err = patch.Write(fdelta.Create(sourceBuf, targetBuf))
-	return err
+	return append(dst, patch...), nil
 }
 
-func (Fdelta) Patch(source io.Reader, target io.Writer, patch io.Reader) error {
-	sourceBuf, err := io.ReadAll(source)
+func (Bsdiff) Patch(dst []byte, source []byte, patch []byte) ([]byte, error) {
+	target, err := bspatch.Bytes(source, patch)
 	if err != nil {
-		return fmt.Errorf("source read all: %s", err)
+		return dst, err
 	}
-	patchBuf, err := io.ReadAll(patch)
-	if err != nil {
-		return fmt.Errorf("patch read all: %s", err)
-	}
-	targetBuf, err := fdelta.Apply(sourceBuf, patchBuf)
+	return append(dst, target...), nil
+}
+
+type Fdelta struct{}
+
+func (Fdelta) Diff(dst []byte, source []byte, target []byte) ([]byte, error) {
+	return append(dst, fdelta.Create(source, target)...), nil
+}
+
+func (Fdelta) Patch(dst []byte, source []byte, patch []byte) ([]byte, error) {
+	target, err := fdelta.Apply(source, patch)
 	if err != nil {
-		return fmt.Errorf("apply patch: %s", err)
+		return dst, fmt.Errorf("apply patch: %s", err)
 	}
-	_, err = target.Write(targetBuf)
-	return err
+	return append(dst, target...), nil
 }
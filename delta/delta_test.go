@@ -0,0 +1,103 @@
+/* Copyright (C) 2021 Nicolas Peugnet <n.peugnet@free.fr>
+
+   This file is part of dna-backup.
+
+   dna-backup is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   dna-backup is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with dna-backup.  If not, see <https://www.gnu.org/licenses/>. */
+
+package delta
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+var codecNames = map[CodecId]string{
+	BsdiffCodec: "Bsdiff",
+	FdeltaCodec: "Fdelta",
+	VcdiffCodec: "Vcdiff",
+}
+
+// similarChunks returns a chunk of the given size and a modified version of it.
+func similarChunks(size int) (source []byte, target []byte) {
+	rand := rand.New(rand.NewSource(1))
+	source = make([]byte, size)
+	rand.Read(source)
+	target = append([]byte{}, source...)
+	for i := 0; i < 8; i++ {
+		pos := rand.Intn(size - 16)
+		rand.Read(target[pos : pos+16])
+	}
+	return
+}
+
+func TestCodecs(t *testing.T) {
+	source, target := similarChunks(8 << 10)
+	for id, name := range codecNames {
+		t.Run(name, func(t *testing.T) {
+			codec, err := Lookup(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if IdOf(codec) != id {
+				t.Errorf("wrong id for %s: %d", name, IdOf(codec))
+			}
+			patch, err := codec.Diff([]byte("prefix"), source, target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.HasPrefix(patch, []byte("prefix")) {
+				t.Fatal("patch must be appended to the given buffer")
+			}
+			result, err := codec.Patch(nil, source, patch[len("prefix"):])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(target, result) {
+				t.Error("patched target does not match")
+			}
+		})
+	}
+}
+
+func BenchmarkDiff(b *testing.B) {
+	source, target := similarChunks(8 << 10)
+	for id, name := range codecNames {
+		codec, _ := Lookup(id)
+		b.Run(name, func(b *testing.B) {
+			var patch []byte
+			b.SetBytes(int64(len(target)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				patch, _ = codec.Diff(patch[:0], source, target)
+			}
+		})
+	}
+}
+
+func BenchmarkPatch(b *testing.B) {
+	source, target := similarChunks(8 << 10)
+	for id, name := range codecNames {
+		codec, _ := Lookup(id)
+		patch, _ := codec.Diff(nil, source, target)
+		b.Run(name, func(b *testing.B) {
+			var result []byte
+			b.SetBytes(int64(len(target)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				result, _ = codec.Patch(result[:0], source, patch)
+			}
+		})
+	}
+}
@@ -0,0 +1,546 @@
+/* Copyright (C) 2021 Nicolas Peugnet <n.peugnet@free.fr>
+
+   This file is part of dna-backup.
+
+   dna-backup is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   dna-backup is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with dna-backup.  If not, see <https://www.gnu.org/licenses/>. */
+
+package delta
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/adler32"
+	"io"
+	"math"
+	"sync"
+)
+
+// Vcdiff produces and applies patches in the VCDIFF format (RFC 3284), which
+// can be decoded by independent tools such as xdelta3 or open-vcdiff.
+//
+// The encoder writes a single window using the whole source as its source
+// segment, and the default code table, without secondary compression. The
+// decoder supports multiple windows, source segments taken from the source
+// (VCD_SOURCE) or from the already decoded target (VCD_TARGET), the whole
+// default code table, as well as the application header and Adler-32
+// checksum extensions of xdelta3.
+type Vcdiff struct{}
+
+var vcdiffMagic = []byte{0xD6, 0xC3, 0xC4, 0x00}
+
+const (
+	vcdDecompress = 0x01 // header indicator: secondary compressor
+	vcdCodetable  = 0x02 // header indicator: application-defined code table
+	vcdAppheader  = 0x04 // header indicator: application header (xdelta3)
+	vcdSource     = 0x01 // window indicator: source segment from the source
+	vcdTarget     = 0x02 // window indicator: source segment from the target
+	vcdAdler32    = 0x04 // window indicator: target checksum (xdelta3)
+)
+
+const (
+	vcdNoop = iota
+	vcdAdd
+	vcdRun
+	vcdCopy
+)
+
+const (
+	vcdSelf   = 0
+	vcdHere   = 1
+	vcdNear   = 4 // s_near: size of the near cache
+	vcdSame   = 3 // s_same: size of the same cache, in blocks of 256
+	vcdModes  = 2 + vcdNear + vcdSame
+	vcdMinLen = 4 // minimum length of a COPY emitted by the encoder
+)
+
+var (
+	ErrVcdiffFormat      = errors.New("vcdiff: invalid patch")
+	ErrVcdiffUnsupported = errors.New("vcdiff: unsupported feature")
+)
+
+type vcdInst struct {
+	kind byte
+	size byte
+	mode byte
+}
+
+type vcdCode [2]vcdInst
+
+// vcdDefaultTable is the default instruction code table of RFC 3284 section 5.6.
+var vcdDefaultTable = func() (table [256]vcdCode) {
+	i := 0
+	add := func(c vcdCode) {
+		table[i] = c
+		i++
+	}
+	add(vcdCode{{kind: vcdRun}})
+	for size := 0; size <= 17; size++ {
+		add(vcdCode{{kind: vcdAdd, size: byte(size)}})
+	}
+	for mode := 0; mode < vcdModes; mode++ {
+		add(vcdCode{{kind: vcdCopy, mode: byte(mode)}})
+		for size := 4; size <= 18; size++ {
+			add(vcdCode{{kind: vcdCopy, size: byte(size), mode: byte(mode)}})
+		}
+	}
+	for mode := 0; mode < vcdModes; mode++ {
+		maxCopy := 6
+		if mode >= 2+vcdNear {
+			maxCopy = 4
+		}
+		for addSize := 1; addSize <= 4; addSize++ {
+			for copySize := 4; copySize <= maxCopy; copySize++ {
+				add(vcdCode{
+					{kind: vcdAdd, size: byte(addSize)},
+					{kind: vcdCopy, size: byte(copySize), mode: byte(mode)},
+				})
+			}
+		}
+	}
+	for mode := 0; mode < vcdModes; mode++ {
+		add(vcdCode{
+			{kind: vcdCopy, size: 4, mode: byte(mode)},
+			{kind: vcdAdd, size: 1},
+		})
+	}
+	return
+}()
+
+// vcdCache is the address cache of RFC 3284 section 5.1.
+type vcdCache struct {
+	near     [vcdNear]int
+	nextSlot int
+	same     [vcdSame * 256]int
+}
+
+func (c *vcdCache) update(addr int) {
+	c.near[c.nextSlot] = addr
+	c.nextSlot = (c.nextSlot + 1) % vcdNear
+	c.same[addr%len(c.same)] = addr
+}
+
+// encode returns the mode giving the shortest encoding of addr, along with its
+// encoded value.
+func (c *vcdCache) encode(addr int, here int) (mode byte, value int) {
+	mode, value = vcdSelf, addr
+	size := varintLen(addr)
+	if d := here - addr; varintLen(d) < size {
+		mode, value, size = vcdHere, d, varintLen(d)
+	}
+	for i, n := range c.near {
+		if d := addr - n; d >= 0 && varintLen(d) < size {
+			mode, value, size = byte(2+i), d, varintLen(d)
+		}
+	}
+	if c.same[addr%len(c.same)] == addr && size > 1 {
+		i := addr % len(c.same)
+		mode, value = byte(2+vcdNear+i/256), i%256
+	}
+	c.update(addr)
+	return
+}
+
+func (c *vcdCache) decode(mode byte, addrs *bytes.Reader, here int) (addr int, err error) {
+	switch {
+	case mode == vcdSelf:
+		addr, err = readVarint(addrs)
+	case mode == vcdHere:
+		addr, err = readVarint(addrs)
+		addr = here - addr
+	case mode < 2+vcdNear:
+		addr, err = readVarint(addrs)
+		addr += c.near[mode-2]
+	case mode < vcdModes:
+		var b byte
+		b, err = addrs.ReadByte()
+		addr = c.same[int(mode-2-vcdNear)*256+int(b)]
+	default:
+		err = ErrVcdiffFormat
+	}
+	if err != nil {
+		return 0, ErrVcdiffFormat
+	}
+	if addr < 0 || addr >= here {
+		return 0, fmt.Errorf("vcdiff: copy address %d out of range", addr)
+	}
+	c.update(addr)
+	return
+}
+
+func varintLen(v int) (n int) {
+	for n = 1; v >= 0x80; n++ {
+		v >>= 7
+	}
+	return
+}
+
+// appendVarint appends v using the base-128 big-endian encoding of VCDIFF.
+func appendVarint(buf []byte, v int) []byte {
+	var tmp [10]byte
+	i := len(tmp) - 1
+	tmp[i] = byte(v & 0x7F)
+	for v >>= 7; v > 0; v >>= 7 {
+		i--
+		tmp[i] = byte(v&0x7F) | 0x80
+	}
+	return append(buf, tmp[i:]...)
+}
+
+func readVarint(r io.ByteReader) (int, error) {
+	var v int
+	for i := 0; i < 9; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		v = v<<7 | int(b&0x7F)
+		if v > math.MaxInt32 {
+			// larger values are not used by the format, and could overflow
+			return 0, ErrVcdiffFormat
+		}
+		if b&0x80 == 0 {
+			return v, nil
+		}
+	}
+	return 0, ErrVcdiffFormat
+}
+
+// vcdEncoder holds the state of an encoding. It is reused between encodings
+// through vcdEncoders to avoid allocating its buffers, and especially its hash
+// table, for each patch.
+type vcdEncoder struct {
+	data  []byte
+	inst  []byte
+	addrs []byte
+	cache vcdCache
+	head  []int32
+	prev  []int32
+}
+
+var vcdEncoders = sync.Pool{
+	New: func() interface{} {
+		return &vcdEncoder{head: make([]int32, 1<<vcdHashBits)}
+	},
+}
+
+func (e *vcdEncoder) reset(size int) {
+	e.data = e.data[:0]
+	e.inst = e.inst[:0]
+	e.addrs = e.addrs[:0]
+	e.cache = vcdCache{}
+	for i := range e.head {
+		e.head[i] = -1
+	}
+	if cap(e.prev) < size {
+		e.prev = make([]int32, size)
+	}
+	e.prev = e.prev[:size]
+}
+
+func (e *vcdEncoder) add(data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	if len(data) <= 17 {
+		e.inst = append(e.inst, byte(1+len(data)))
+	} else {
+		e.inst = append(e.inst, 1)
+		e.inst = appendVarint(e.inst, len(data))
+	}
+	e.data = append(e.data, data...)
+}
+
+func (e *vcdEncoder) copy(addr int, size int, here int) {
+	mode, value := e.cache.encode(addr, here)
+	code := 19 + 16*int(mode)
+	if size <= 18 {
+		e.inst = append(e.inst, byte(code+size-3))
+	} else {
+		e.inst = append(e.inst, byte(code))
+		e.inst = appendVarint(e.inst, size)
+	}
+	if mode >= 2+vcdNear {
+		e.addrs = append(e.addrs, byte(value))
+	} else {
+		e.addrs = appendVarint(e.addrs, value)
+	}
+}
+
+const (
+	vcdHashBits  = 16
+	vcdMaxChain  = 16
+	vcdHashShift = 32 - vcdHashBits
+)
+
+func vcdHash(b []byte) uint32 {
+	return (binary.LittleEndian.Uint32(b) * 2654435761) >> vcdHashShift
+}
+
+// at returns the byte at the given address of the window, whose address space
+// is the source segment followed by the target.
+func at(source []byte, target []byte, addr int) byte {
+	if addr < len(source) {
+		return source[addr]
+	}
+	return target[addr-len(source)]
+}
+
+// Diff greedily encodes target as COPY instructions of the longest matches
+// found in the source and in the already encoded part of the target, and ADD
+// instructions for the remaining bytes.
+func (Vcdiff) Diff(dst []byte, source []byte, target []byte) ([]byte, error) {
+	e := vcdEncoders.Get().(*vcdEncoder)
+	defer vcdEncoders.Put(e)
+	srcLen := len(source)
+	size := srcLen + len(target)
+	e.reset(size)
+	insert := func(pos int) {
+		if pos+vcdMinLen > size {
+			return
+		}
+		var h uint32
+		if pos+vcdMinLen <= srcLen {
+			h = vcdHash(source[pos:])
+		} else if pos >= srcLen {
+			h = vcdHash(target[pos-srcLen:])
+		} else {
+			var b [vcdMinLen]byte
+			for i := range b {
+				b[i] = at(source, target, pos+i)
+			}
+			h = vcdHash(b[:])
+		}
+		e.prev[pos] = e.head[h]
+		e.head[h] = int32(pos)
+	}
+	for i := 0; i < srcLen; i++ {
+		insert(i)
+	}
+	pending := srcLen
+	for here := srcLen; here < size; {
+		var bestAddr, bestLen int
+		if here+vcdMinLen <= size {
+			cand := e.head[vcdHash(target[here-srcLen:])]
+			for chain := 0; cand >= 0 && chain < vcdMaxChain; chain++ {
+				c := int(cand)
+				limit := size - here
+				if c < srcLen && srcLen-c < limit {
+					// a copy cannot span the source segment and the target
+					limit = srcLen - c
+				}
+				n := 0
+				for n < limit && at(source, target, c+n) == target[here-srcLen+n] {
+					n++
+				}
+				if n > bestLen {
+					bestAddr, bestLen = c, n
+				}
+				cand = e.prev[c]
+			}
+		}
+		if bestLen < vcdMinLen {
+			insert(here)
+			here++
+			continue
+		}
+		e.add(target[pending-srcLen : here-srcLen])
+		e.copy(bestAddr, bestLen, here)
+		for end := here + bestLen; here < end; here++ {
+			insert(here)
+		}
+		pending = here
+	}
+	e.add(target[pending-srcLen:])
+
+	dst = append(dst, vcdiffMagic...)
+	dst = append(dst, 0) // Hdr_Indicator
+	if srcLen > 0 {
+		dst = append(dst, vcdSource)
+		dst = appendVarint(dst, srcLen)
+		dst = appendVarint(dst, 0)
+	} else {
+		dst = append(dst, 0)
+	}
+	deltaLen := varintLen(len(target)) + 1 + varintLen(len(e.data)) +
+		varintLen(len(e.inst)) + varintLen(len(e.addrs)) +
+		len(e.data) + len(e.inst) + len(e.addrs)
+	dst = appendVarint(dst, deltaLen)
+	dst = appendVarint(dst, len(target))
+	dst = append(dst, 0) // Delta_Indicator: no secondary compression
+	dst = appendVarint(dst, len(e.data))
+	dst = appendVarint(dst, len(e.inst))
+	dst = appendVarint(dst, len(e.addrs))
+	dst = append(dst, e.data...)
+	dst = append(dst, e.inst...)
+	dst = append(dst, e.addrs...)
+	return dst, nil
+}
+
+// Patch decodes the VCDIFF patch and applies it to source.
+func (v Vcdiff) Patch(dst []byte, source []byte, patch []byte) ([]byte, error) {
+	return v.patchLimit(dst, source, patch, -1)
+}
+
+// patchLimit is like Patch, but a patch announcing a target larger than limit is
+// rejected before decoding it. A negative limit means no limit.
+func (Vcdiff) patchLimit(dst []byte, source []byte, patch []byte, limit int) ([]byte, error) {
+	r := bytes.NewReader(patch)
+	var magic [4]byte
+	if _, err := io.ReadFull(r, magic[:]); err != nil || !bytes.Equal(magic[:], vcdiffMagic) {
+		return dst, ErrVcdiffFormat
+	}
+	indicator, err := r.ReadByte()
+	if err != nil {
+		return dst, ErrVcdiffFormat
+	}
+	if indicator&(vcdDecompress|vcdCodetable) != 0 {
+		return dst, ErrVcdiffUnsupported
+	}
+	if indicator&vcdAppheader != 0 {
+		n, err := readVarint(r)
+		if err != nil || n > r.Len() {
+			return dst, ErrVcdiffFormat
+		}
+		r.Seek(int64(n), io.SeekCurrent)
+	}
+	start := len(dst)
+	for r.Len() > 0 {
+		if dst, err = decodeWindow(r, source, dst, start, limit); err != nil {
+			return dst, err
+		}
+	}
+	return dst, nil
+}
+
+// decodeWindow decodes the next window of r and appends its target to dst,
+// whose decoded target starts at start. If limit is not negative, the whole
+// decoded target must not be larger.
+func decodeWindow(r *bytes.Reader, source []byte, dst []byte, start, limit int) ([]byte, error) {
+	indicator, err := r.ReadByte()
+	if err != nil {
+		return dst, ErrVcdiffFormat
+	}
+	var segment []byte
+	if indicator&(vcdSource|vcdTarget) != 0 {
+		size, err1 := readVarint(r)
+		pos, err2 := readVarint(r)
+		if err1 != nil || err2 != nil {
+			return dst, ErrVcdiffFormat
+		}
+		from := source
+		if indicator&vcdTarget != 0 {
+			from = dst[start:]
+		}
+		if size > len(from) || pos > len(from)-size {
+			return dst, fmt.Errorf("vcdiff: source segment %d+%d out of range", pos, size)
+		}
+		segment = from[pos : pos+size]
+	}
+	var lengths [5]int // delta encoding, target window, data, instructions, addresses
+	for i := range lengths {
+		if i == 2 {
+			deltaIndicator, err := r.ReadByte()
+			if err != nil {
+				return dst, ErrVcdiffFormat
+			}
+			if deltaIndicator != 0 {
+				return dst, ErrVcdiffUnsupported
+			}
+		}
+		if lengths[i], err = readVarint(r); err != nil {
+			return dst, ErrVcdiffFormat
+		}
+	}
+	var checksum [4]byte
+	if indicator&vcdAdler32 != 0 {
+		if _, err = io.ReadFull(r, checksum[:]); err != nil {
+			return dst, ErrVcdiffFormat
+		}
+	}
+	sectionsLen := 0
+	for _, l := range lengths[2:] {
+		if l > r.Len()-sectionsLen {
+			return dst, ErrVcdiffFormat
+		}
+		sectionsLen += l
+	}
+	sections := make([]byte, sectionsLen)
+	r.Read(sections)
+	data := bytes.NewReader(sections[:lengths[2]])
+	inst := bytes.NewReader(sections[lengths[2] : lengths[2]+lengths[3]])
+	addrs := bytes.NewReader(sections[lengths[2]+lengths[3]:])
+
+	size := lengths[1]
+	winStart := len(dst)
+	if limit >= 0 && size > limit-(winStart-start) {
+		return dst, fmt.Errorf("vcdiff: target window of %d bytes exceeds the expected target size", size)
+	}
+	// the buffer is not grown upfront from the announced size, which is not
+	// trusted: it grows as the target is actually decoded
+	var cache vcdCache
+	for inst.Len() > 0 {
+		index, _ := inst.ReadByte()
+		for _, in := range vcdDefaultTable[index] {
+			if in.kind == vcdNoop {
+				continue
+			}
+			n := int(in.size)
+			if n == 0 {
+				if n, err = readVarint(inst); err != nil {
+					return dst, ErrVcdiffFormat
+				}
+			}
+			if n > size-(len(dst)-winStart) {
+				return dst, fmt.Errorf("vcdiff: target window overflow")
+			}
+			switch in.kind {
+			case vcdAdd:
+				if n > data.Len() {
+					return dst, ErrVcdiffFormat
+				}
+				l := lengths[2] - data.Len()
+				dst = append(dst, sections[l:l+n]...)
+				data.Seek(int64(n), io.SeekCurrent)
+			case vcdRun:
+				b, err := data.ReadByte()
+				if err != nil {
+					return dst, ErrVcdiffFormat
+				}
+				for i := 0; i < n; i++ {
+					dst = append(dst, b)
+				}
+			case vcdCopy:
+				here := len(segment) + len(dst) - winStart
+				addr, err := cache.decode(in.mode, addrs, here)
+				if err != nil {
+					return dst, err
+				}
+				// copies from the target may overlap the data being produced
+				for i := 0; i < n; i++ {
+					dst = append(dst, at(segment, dst[winStart:], addr+i))
+				}
+			}
+		}
+	}
+	window := dst[winStart:]
+	if len(window) != size {
+		return dst, fmt.Errorf("vcdiff: target window of %d bytes instead of %d", len(window), size)
+	}
+	if indicator&vcdAdler32 != 0 && adler32.Checksum(window) != binary.BigEndian.Uint32(checksum[:]) {
+		return dst, fmt.Errorf("vcdiff: target window checksum mismatch")
+	}
+	return dst, nil
+}
@@ -0,0 +1,190 @@
+/* Copyright (C) 2021 Nicolas Peugnet <n.peugnet@free.fr>
+
+   This file is part of dna-backup.
+
+   dna-backup is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   dna-backup is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with dna-backup.  If not, see <https://www.gnu.org/licenses/>. */
+
+package delta
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestVcdiffRoundtrip(t *testing.T) {
+	rand := rand.New(rand.NewSource(1))
+	source := make([]byte, 8<<10)
+	rand.Read(source)
+	modified := append([]byte{}, source...)
+	copy(modified[100:], "some inserted text")
+	modified = append(modified[:4000], modified[4100:]...)
+	modified = append(modified, bytes.Repeat([]byte("run"), 200)...)
+	cases := []struct {
+		name   string
+		source []byte
+		target []byte
+	}{
+		{"Modified", source, modified},
+		{"Same", source, source},
+		{"EmptySource", nil, modified},
+		{"EmptyTarget", source, nil},
+		{"Empty", nil, nil},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			patch, err := (Vcdiff{}).Diff(nil, c.source, c.target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.name == "Modified" && len(patch) > 200 {
+				t.Errorf("patch is too big: %d bytes", len(patch))
+			}
+			// the result must be appended to the given buffer
+			target, err := (Vcdiff{}).Patch([]byte("prefix"), c.source, patch)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(append([]byte("prefix"), c.target...), target) {
+				t.Error("patched target does not match")
+			}
+		})
+	}
+}
+
+// TestVcdiffDecode decodes a patch written by hand following RFC 3284, that
+// uses instructions of the default code table not emitted by our encoder.
+func TestVcdiffDecode(t *testing.T) {
+	patch := []byte{
+		0xD6, 0xC3, 0xC4, 0x00, 0x00, // header
+		0x01, 0x08, 0x00, // VCD_SOURCE of 8 bytes at position 0
+		0x0F,             // delta encoding length
+		0x0E,             // target window length
+		0x00,             // delta indicator
+		0x04, 0x04, 0x02, // data, instructions and addresses lengths
+		'X', 'Y', 'Z', '!', // data
+		166, 0, 3, 248, // ADD 2 + COPY 4 SELF, RUN 3, COPY 4 HERE + ADD 1
+		0, 17, // addresses
+	}
+	target, err := (Vcdiff{}).Patch(nil, []byte("abcdefgh"), patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(target) != "XYabcdZZZabcd!" {
+		t.Errorf("wrong target: %q", target)
+	}
+	patch[len(patch)-1] = 30 // address after the current position
+	if _, err := (Vcdiff{}).Patch(nil, []byte("abcdefgh"), patch); err == nil {
+		t.Error("an invalid address should return an error")
+	}
+}
+
+// TestVcdiffInterop decodes the standard patch of the decoder tests of
+// open-vcdiff, which uses explicit instruction sizes, a RUN and a NEAR copy.
+func TestVcdiffInterop(t *testing.T) {
+	dictionary := "\"Just the place for a Snark!\" the Bellman cried,\n" +
+		"As he landed his crew with care;\n" +
+		"Supporting each man on the top of the tide\n" +
+		"By a finger entwined in his hair.\n"
+	expected := "\"Just the place for a Snark! I have said it twice:\n" +
+		"That alone should encourage the crew.\n" +
+		"Just the place for a Snark! I have said it thrice:\n" +
+		"What I tell you three times is true.\"\n"
+	patch := []byte{
+		0xD6, 0xC3, 0xC4, 0x00, 0x00, // header
+		0x01, 0x81, 0x1F, 0x00, // VCD_SOURCE of 159 bytes at position 0
+		0x79,       // delta encoding length
+		0x81, 0x32, // target window length
+		0x00,             // delta indicator
+		0x64, 0x0C, 0x03, // data, instructions and addresses lengths
+	}
+	patch = append(patch, " I have said it twice:\nThat alone should encourage the crew.\n"+
+		"hr"+"What I te"+"l"+" you three times is true.\"\n"...)
+	patch = append(patch,
+		0x13, 0x1C, // COPY 28 SELF
+		0x01, 0x3D, // ADD 61
+		0x23, 0x2C, // COPY 44 HERE
+		0xCB,       // ADD 2 + COPY 5 NEAR(1)
+		0x0A,       // ADD 9
+		0x00, 0x02, // RUN 2
+		0x01, 0x1B, // ADD 27
+		0x00, 0x58, 0x2D, // addresses
+	)
+	if len(dictionary) != 159 || len(expected) != 178 {
+		t.Fatalf("wrong vector lengths: %d, %d", len(dictionary), len(expected))
+	}
+	target, err := (Vcdiff{}).Patch(nil, []byte(dictionary), patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(target) != expected {
+		t.Errorf("wrong target: %q", target)
+	}
+	// like the append built-in, the capacity of dst is not a limit
+	target, err = (Vcdiff{}).Patch(make([]byte, 0, len(expected)-1), []byte(dictionary), patch)
+	if err != nil || string(target) != expected {
+		t.Errorf("target larger than the capacity should be decoded: %q, %v", target, err)
+	}
+	if _, err := PatchLimit(Vcdiff{}, nil, []byte(dictionary), patch, len(expected)-1); err == nil {
+		t.Error("a target larger than expected should return an error")
+	}
+	target, err = PatchLimit(Vcdiff{}, nil, []byte(dictionary), patch, len(expected))
+	if err != nil || string(target) != expected {
+		t.Errorf("target of the expected size should be decoded: %q, %v", target, err)
+	}
+}
+
+// TestVcdiffWindowSize checks that the announced size of a target window is not
+// trusted to allocate the target.
+func TestVcdiffWindowSize(t *testing.T) {
+	patch := []byte{
+		0xD6, 0xC3, 0xC4, 0x00, 0x00, // header
+		0x00,                         // no source segment
+		0x08,                         // delta encoding length
+		0x87, 0xFF, 0xFF, 0xFF, 0x7F, // target window length: 2GiB - 1
+		0x00,             // delta indicator
+		0x00, 0x00, 0x00, // data, instructions and addresses lengths
+	}
+	if _, err := (Vcdiff{}).Patch(nil, nil, patch); err == nil {
+		t.Error("a truncated target window should return an error")
+	}
+	if _, err := PatchLimit(Vcdiff{}, nil, nil, patch, 1024); err == nil {
+		t.Error("a target window larger than expected should return an error")
+	}
+}
+
+// TestVcdiffOverflow checks that sizes whose sum overflows are rejected.
+func TestVcdiffOverflow(t *testing.T) {
+	header := []byte{0xD6, 0xC3, 0xC4, 0x00, 0x00}
+	maxInt64 := []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0x7F}
+	patches := map[string][]byte{
+		"SourceSegment": append(append(append(header,
+			0x01), maxInt64...), // VCD_SOURCE of 2^63-1 bytes
+			0x01,                               // at position 1
+			0x04, 0x00, 0x00, 0x00, 0x00, 0x00, // empty window
+		),
+		"Sections": append(append(append(header,
+			0x00, 0x0F, 0x00, 0x00), maxInt64...), // data length: 2^63-1
+			0x01, 0x00, // instructions and addresses lengths
+			0x00,
+		),
+	}
+	for name, patch := range patches {
+		t.Run(name, func(t *testing.T) {
+			if _, err := (Vcdiff{}).Patch(nil, []byte("abcdefgh"), patch); err != ErrVcdiffFormat {
+				t.Errorf("an overflowing size should return %v, got %v", ErrVcdiffFormat, err)
+			}
+		})
+	}
+}
@@ -48,10 +48,28 @@ type Pool struct {
 	TrackCount int
 }
 
+// Header is the gob encoded header of an exported version, written at the start
+// of its track in the first pool. It gives the size of each of its parts: the
+// chunks are written forward in the other pools, while the recipe is written in
+// the rest of the track, followed by the files, the dictionary and the index,
+// whatever does not fit being written backward from the last pool.
+//
+// Readers of the drive must stay compatible with the headers written before the
+// Dictionary and Index fields, and then the snapshot flags, were added: gob
+// decodes their missing values as zero, meaning that there is no dictionary nor
+// index and that the recipe and the files are deltas. As these parts are
+// appended after the files, a reader that does not know them can still read the
+// recipe and the files of newer versions, but not decompress their chunks if
+// they use a dictionary.
 type Header struct {
-	Chunks uint64
-	Recipe uint64
-	Files  uint64
+	Chunks     uint64
+	Recipe     uint64
+	Files      uint64
+	Dictionary uint64
+	Index      uint64
+	// whether the recipe and the files are full snapshots instead of deltas
+	RecipeSnapshot bool
+	FilesSnapshot  bool
 }
 
 func New(
@@ -82,29 +100,35 @@ func New(
 	}
 }
 
-func (d *DnaDrive) ExportVersion(end chan<- bool) export.Input {
+func (d *DnaDrive) ExportVersion(metadata export.Metadata, end chan<- bool) export.Input {
 	rChunks, wChunks := io.Pipe()
 	rRecipe, wRecipe := io.Pipe()
 	rFiles, wFiles := io.Pipe()
+	rDictionary, wDictionary := io.Pipe()
+	rIndex, wIndex := io.Pipe()
 	version := export.Version{
 		Input: export.Input{
-			Chunks: wChunks,
-			Recipe: wRecipe,
-			Files:  wFiles,
+			Chunks:     wChunks,
+			Recipe:     wRecipe,
+			Files:      wFiles,
+			Dictionary: wDictionary,
+			Index:      wIndex,
 		},
 		Output: export.Output{
-			Chunks: rChunks,
-			Recipe: rRecipe,
-			Files:  rFiles,
+			Chunks:     rChunks,
+			Recipe:     rRecipe,
+			Files:      rFiles,
+			Dictionary: rDictionary,
+			Index:      rIndex,
 		},
 	}
-	go d.writeVersion(version.Output, end)
+	go d.writeVersion(metadata, version.Output, end)
 	return version.Input
 }
 
-func (d *DnaDrive) writeVersion(output export.Output, end chan<- bool) {
+func (d *DnaDrive) writeVersion(metadata export.Metadata, output export.Output, end chan<- bool) {
 	var err error
-	var recipe, files, version bytes.Buffer
+	var recipe, files, dictionary, index, version bytes.Buffer
 	n := write(output.Chunks, d.pools[1:], d.trackSize, d.tracksPerPool, Forward)
 	_, err = io.Copy(&recipe, output.Recipe)
 	if err != nil {
@@ -114,11 +138,26 @@ func (d *DnaDrive) writeVersion(output export.Output, end chan<- bool) {
 	if err != nil {
 		logger.Error("dna export files ", err)
 	}
+	_, err = io.Copy(&dictionary, output.Dictionary)
+	if err != nil {
+		logger.Error("dna export dictionary ", err)
+	}
+	_, err = io.Copy(&index, output.Index)
+	if err != nil {
+		logger.Error("dna export index ", err)
+	}
 	header := Header{
 		uint64(n),
 		uint64(recipe.Len()),
 		uint64(files.Len()),
+		uint64(dictionary.Len()),
+		uint64(index.Len()),
+		metadata.RecipeSnapshot,
+		metadata.FilesSnapshot,
 	}
+	// the dictionary and the index are written right after the files
+	io.Copy(&files, &dictionary)
+	io.Copy(&files, &index)
 	e := gob.NewEncoder(&version)
 	err = e.Encode(header)
 	if err != nil {
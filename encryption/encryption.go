@@ -0,0 +1,275 @@
+/* Copyright (C) 2021 Nicolas Peugnet <n.peugnet@free.fr>
+
+   This file is part of dna-backup.
+
+   dna-backup is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   dna-backup is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with dna-backup.  If not, see <https://www.gnu.org/licenses/>. */
+
+/*
+Authenticated encryption of the repo's data using XChaCha20-Poly1305.
+
+Encrypted streams are split into segments that are sealed independently, so
+that they can be written and read without buffering their whole content:
+
+	nonce prefix (19 bytes) | segment 0 | segment 1 | ... | last segment
+
+Each segment holds at most SegmentSize bytes of plaintext followed by the
+Poly1305 tag. Its nonce is the prefix, followed by the segment counter (4 bytes,
+big-endian) and a flag set to 1 for the last segment only, so that reordered or
+truncated streams are detected.
+*/
+package encryption
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/n-peugnet/dna-backup/logger"
+	"github.com/n-peugnet/dna-backup/utils"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	KeySize     = chacha20poly1305.KeySize
+	SegmentSize = 64 << 10
+	prefixSize  = chacha20poly1305.NonceSizeX - 5
+	overhead    = chacha20poly1305.Overhead
+	checkLabel  = "dna-backup key check"
+)
+
+var (
+	ErrWrongSecret = errors.New("wrong passphrase or key file")
+	ErrCorrupted   = errors.New("encrypted stream is corrupted or truncated")
+)
+
+// Params are the parameters needed to derive the key of a repo from its secret.
+// They are not secret themselves and are stored along the repo.
+type Params struct {
+	Salt  []byte
+	N     int
+	R     int
+	P     int
+	Check []byte
+}
+
+// NewParams generates new key derivation parameters with a random salt, and
+// returns them along with the key derived from the given secret.
+func NewParams(secret []byte) (params *Params, key []byte, err error) {
+	params = &Params{Salt: make([]byte, 32), N: 1 << 15, R: 8, P: 1}
+	if _, err = rand.Read(params.Salt); err != nil {
+		return nil, nil, err
+	}
+	if key, err = params.derive(secret); err != nil {
+		return nil, nil, err
+	}
+	params.Check = check(key)
+	return
+}
+
+// Key derives the key from the given secret, which can be a passphrase or the
+// content of a key file.
+// ErrWrongSecret is returned if it does not match the one used to create them.
+func (p *Params) Key(secret []byte) ([]byte, error) {
+	key, err := p.derive(secret)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(check(key), p.Check) {
+		return nil, ErrWrongSecret
+	}
+	return key, nil
+}
+
+func (p *Params) derive(secret []byte) ([]byte, error) {
+	return scrypt.Key(secret, p.Salt, p.N, p.R, p.P, KeySize)
+}
+
+func check(key []byte) []byte {
+	return SubKey(key, checkLabel)
+}
+
+// SubKey derives from key a new independent key for the given purpose.
+func SubKey(key []byte, label string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(label))
+	return mac.Sum(nil)
+}
+
+func setNonce(nonce []byte, counter uint32, last bool) {
+	binary.BigEndian.PutUint32(nonce[prefixSize:], counter)
+	if last {
+		nonce[len(nonce)-1] = 1
+	} else {
+		nonce[len(nonce)-1] = 0
+	}
+}
+
+type writer struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	nonce   []byte
+	counter uint32
+	plain   []byte
+	sealed  []byte
+}
+
+// NewWriter returns a WriteCloser that encrypts the data written to it into w.
+// It must be closed to write the last segment.
+func NewWriter(w io.Writer, key []byte) (io.WriteCloser, error) {
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce[:prefixSize]); err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(nonce[:prefixSize]); err != nil {
+		return nil, err
+	}
+	return &writer{
+		w:      w,
+		aead:   aead,
+		nonce:  nonce,
+		plain:  make([]byte, 0, SegmentSize),
+		sealed: make([]byte, 0, SegmentSize+overhead),
+	}, nil
+}
+
+func (w *writer) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		// a full segment is only sealed once we know it is not the last one
+		if len(w.plain) == SegmentSize {
+			if err = w.seal(false); err != nil {
+				return
+			}
+		}
+		free := SegmentSize - len(w.plain)
+		if free > len(p) {
+			free = len(p)
+		}
+		w.plain = append(w.plain, p[:free]...)
+		p = p[free:]
+		n += free
+	}
+	return
+}
+
+func (w *writer) seal(last bool) error {
+	if w.counter == ^uint32(0) {
+		return errors.New("encrypted stream is too long")
+	}
+	setNonce(w.nonce, w.counter, last)
+	w.sealed = w.aead.Seal(w.sealed[:0], w.nonce, w.plain, nil)
+	w.counter++
+	w.plain = w.plain[:0]
+	_, err := w.w.Write(w.sealed)
+	return err
+}
+
+func (w *writer) Close() error {
+	return w.seal(true)
+}
+
+type reader struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	nonce   []byte
+	counter uint32
+	sealed  []byte
+	plain   []byte
+	done    bool
+}
+
+// NewReader returns a ReadCloser that decrypts the data read from r and
+// authenticates it.
+func NewReader(r io.Reader, key []byte) (io.ReadCloser, error) {
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = io.ReadFull(r, nonce[:prefixSize]); err != nil {
+		return nil, ErrCorrupted
+	}
+	return &reader{
+		r:      bufio.NewReaderSize(r, SegmentSize+overhead),
+		aead:   aead,
+		nonce:  nonce,
+		sealed: make([]byte, SegmentSize+overhead),
+	}, nil
+}
+
+func (r *reader) Read(p []byte) (n int, err error) {
+	for len(r.plain) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err = r.open(); err != nil {
+			return
+		}
+	}
+	n = copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return
+}
+
+func (r *reader) open() error {
+	n, err := io.ReadFull(r.r, r.sealed)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		r.done = true
+	} else if err != nil {
+		return err
+	} else if _, err = r.r.Peek(1); err == io.EOF {
+		r.done = true
+	}
+	if n < overhead {
+		return ErrCorrupted
+	}
+	setNonce(r.nonce, r.counter, r.done)
+	r.plain, err = r.aead.Open(r.sealed[:0], r.nonce, r.sealed[:n], nil)
+	if err != nil {
+		return ErrCorrupted
+	}
+	r.counter++
+	return nil
+}
+
+func (r *reader) Close() error {
+	return nil
+}
+
+// ReadWrapper returns a wrapper that decrypts data with the given key.
+func ReadWrapper(key []byte) utils.ReadWrapper {
+	return func(r io.Reader) (io.ReadCloser, error) {
+		return NewReader(r, key)
+	}
+}
+
+// WriteWrapper returns a wrapper that encrypts data with the given key.
+func WriteWrapper(key []byte) utils.WriteWrapper {
+	return func(w io.Writer) io.WriteCloser {
+		wc, err := NewWriter(w, key)
+		if err != nil {
+			logger.Panic("encryption ", err)
+		}
+		return wc
+	}
+}
@@ -0,0 +1,100 @@
+/* Copyright (C) 2021 Nicolas Peugnet <n.peugnet@free.fr>
+
+   This file is part of dna-backup.
+
+   dna-backup is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   dna-backup is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with dna-backup.  If not, see <https://www.gnu.org/licenses/>. */
+
+package encryption
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func encrypt(t *testing.T, key []byte, data []byte) []byte {
+	var buff bytes.Buffer
+	w, err := NewWriter(&buff, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buff.Bytes()
+}
+
+func decrypt(key []byte, data []byte) ([]byte, error) {
+	r, err := NewReader(bytes.NewReader(data), key)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+func TestRoundtrip(t *testing.T) {
+	key := make([]byte, KeySize)
+	for _, size := range []int{0, 1, SegmentSize - 1, SegmentSize, SegmentSize + 1, 3 * SegmentSize} {
+		data := bytes.Repeat([]byte{42}, size)
+		sealed := encrypt(t, key, data)
+		actual, err := decrypt(key, sealed)
+		if err != nil {
+			t.Fatal(size, err)
+		}
+		if !bytes.Equal(data, actual) {
+			t.Errorf("size %d: decrypted data does not match", size)
+		}
+	}
+}
+
+func TestCorrupted(t *testing.T) {
+	key := make([]byte, KeySize)
+	data := bytes.Repeat([]byte("secret"), SegmentSize/3)
+	sealed := encrypt(t, key, data)
+
+	tampered := append([]byte{}, sealed...)
+	tampered[len(tampered)/2] ^= 1
+	if _, err := decrypt(key, tampered); err != ErrCorrupted {
+		t.Error("tampered stream should not be decrypted, err:", err)
+	}
+	truncated := sealed[:prefixSize+SegmentSize+overhead]
+	if _, err := decrypt(key, truncated); err != ErrCorrupted {
+		t.Error("truncated stream should not be decrypted, err:", err)
+	}
+	other := make([]byte, KeySize)
+	other[0] = 1
+	if _, err := decrypt(other, sealed); err != ErrCorrupted {
+		t.Error("stream should not be decrypted with another key, err:", err)
+	}
+}
+
+func TestParams(t *testing.T) {
+	params, key, err := NewParams([]byte("passphrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual, err := params.Key([]byte("passphrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(key, actual) {
+		t.Error("derived keys do not match")
+	}
+	if _, err = params.Key([]byte("wrong")); err != ErrWrongSecret {
+		t.Error("wrong secret should be detected, err:", err)
+	}
+}
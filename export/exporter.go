@@ -8,17 +8,28 @@ type Version struct {
 }
 
 type Input struct {
-	Chunks io.WriteCloser
-	Recipe io.WriteCloser
-	Files  io.WriteCloser
+	Chunks     io.WriteCloser
+	Recipe     io.WriteCloser
+	Files      io.WriteCloser
+	Dictionary io.WriteCloser
+	Index      io.WriteCloser
 }
 
 type Output struct {
-	Chunks io.ReadCloser
-	Recipe io.ReadCloser
-	Files  io.ReadCloser
+	Chunks     io.ReadCloser
+	Recipe     io.ReadCloser
+	Files      io.ReadCloser
+	Dictionary io.ReadCloser
+	Index      io.ReadCloser
+}
+
+// Metadata tells how the metadata of an exported version are encoded, as each
+// of them is either a full snapshot or a delta against the previous version.
+type Metadata struct {
+	RecipeSnapshot bool
+	FilesSnapshot  bool
 }
 
 type Exporter interface {
-	ExportVersion(end chan<- bool) Input
+	ExportVersion(metadata Metadata, end chan<- bool) Input
 }
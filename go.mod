@@ -1,9 +1,17 @@
 module github.com/n-peugnet/dna-backup
 
-go 1.16
+go 1.18
 
 require (
 	github.com/chmduquesne/rollinghash v4.0.0+incompatible
 	github.com/gabstv/go-bsdiff v1.0.5
+	github.com/klauspost/compress v1.17.0
 	github.com/mdvan/fdelta v0.0.0-20200114160834-373fc49c9ba9
+	github.com/ulikunitz/xz v0.5.10
+	golang.org/x/crypto v0.0.0-20211215153901-e495a2d5b3d3
+)
+
+require (
+	github.com/dsnet/compress v0.0.0-20171208185109-cc9eb1d7ad76 // indirect
+	golang.org/x/sys v0.0.0-20210615035016-665e8c7367d1 // indirect
 )
@@ -21,6 +21,7 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"runtime"
 
 	"github.com/n-peugnet/dna-backup/dna"
 	"github.com/n-peugnet/dna-backup/logger"
@@ -35,17 +36,33 @@ type command struct {
 }
 
 const (
-	name      = "dna-backup"
-	baseUsage = "<command> [<options>] [--] <args>"
+	name          = "dna-backup"
+	baseUsage     = "<command> [<options>] [--] <args>"
+	passphraseEnv = "DNA_BACKUP_PASSPHRASE"
 )
 
 var (
-	logLevel      int
-	chunkSize     int
-	format        string
-	poolCount     int
-	trackSize     int
-	tracksPerPool int
+	logLevel           int
+	chunkSize          int
+	format             string
+	poolCount          int
+	trackSize          int
+	tracksPerPool      int
+	keyFile            string
+	compression        string
+	level              int
+	dictSize           int
+	groupTracks        int
+	deltaGain          float64
+	candidates         int
+	deltaDepth         int
+	jobs               int
+	sketcher           string
+	chunkerName        string
+	spoolDir           string
+	skipUnchanged      bool
+	checkpointInterval int
+	checkpointRatio    float64
 )
 
 var Commit = command{flag.NewFlagSet("commit", flag.ExitOnError), commitMain,
@@ -79,11 +96,27 @@ func init() {
 	for _, s := range subcommands {
 		s.Flag.IntVar(&logLevel, "v", 3, "log verbosity level (0-4)")
 		s.Flag.IntVar(&chunkSize, "c", 8<<10, "chunk size")
+		s.Flag.StringVar(&keyFile, "key-file", "", "file used as encryption key, instead of the "+passphraseEnv+" env var")
 	}
+	Commit.Flag.StringVar(&compression, "compression", "zlib", "compression algorithm of a new repo (none, zlib, zstd, xz)")
+	Commit.Flag.IntVar(&level, "level", 0, "compression level of a new repo (only for zstd, 1-22)")
+	Commit.Flag.Float64Var(&deltaGain, "delta-gain", 0, "minimum size gain in percent of a patch to store a chunk as a delta")
+	Commit.Flag.IntVar(&candidates, "candidates", 1, "number of similar chunks tried to delta-encode a chunk")
+	Commit.Flag.IntVar(&deltaDepth, "depth", 1, "maximum number of patches needed to restore a chunk")
+	Commit.Flag.StringVar(&sketcher, "sketch", "region", "sketch algorithm of a new repo (region, transform, gear)")
+	Commit.Flag.StringVar(&chunkerName, "chunker", "fixed", "chunking algorithm of a new repo (fixed, fastcdc)")
+	Commit.Flag.StringVar(&spoolDir, "spool", "", "directory where the source is spooled during the commit (default to the system temporary directory)")
+	Commit.Flag.BoolVar(&skipUnchanged, "skip-unchanged", false, "do not read the files whose size, modification time and inode did not change since the previous version")
+	Commit.Flag.IntVar(&jobs, "j", runtime.NumCPU(), "number of chunks encoded and stored in parallel")
+	Commit.Flag.IntVar(&checkpointInterval, "checkpoint", 64, "maximum number of metadata deltas between two full snapshots (0 for no limit)")
+	Commit.Flag.Float64Var(&checkpointRatio, "checkpoint-ratio", 1, "maximum size of the metadata deltas since the last full snapshot, relative to a new snapshot (0 for no limit)")
+	Commit.Flag.IntVar(&dictSize, "dict", 0, "size of the trained compression dictionary of a new repo (only for zstd)")
+	Restore.Flag.IntVar(&jobs, "j", runtime.NumCPU(), "number of chunks decoded in parallel")
 	Export.Flag.StringVar(&format, "format", "dir", "format of the export (dir, csv)")
 	Export.Flag.IntVar(&poolCount, "pools", 96, "number of pools")
 	Export.Flag.IntVar(&trackSize, "track", 1020, "size of a DNA track")
 	Export.Flag.IntVar(&tracksPerPool, "tracks-per-pool", 10000, "number of tracks per pool")
+	Export.Flag.IntVar(&groupTracks, "group", 0, "compress chunks in independent groups of this number of tracks (0 to compress them all at once)")
 }
 
 func main() {
@@ -111,13 +144,47 @@ func main() {
 	}
 }
 
+// newRepo creates a repo with the secret given either by the key file or by the
+// passphrase env var, if any.
+func newRepo(path string) *repo.Repo {
+	r := repo.NewRepo(path, chunkSize)
+	if keyFile != "" {
+		secret, err := os.ReadFile(keyFile)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		r.SetSecret(secret)
+	} else if passphrase, exists := os.LookupEnv(passphraseEnv); exists {
+		r.SetSecret([]byte(passphrase))
+	}
+	return r
+}
+
 func commitMain(args []string) error {
 	if len(args) != 2 {
 		return fmt.Errorf("wrong number of args")
 	}
 	source := args[0]
 	dest := args[1]
-	r := repo.NewRepo(dest, chunkSize)
+	r := newRepo(dest)
+	if err := r.SetCompression(compression, level); err != nil {
+		return err
+	}
+	r.SetDictionarySize(dictSize)
+	if err := r.SetSketcher(sketcher); err != nil {
+		return err
+	}
+	if err := r.SetChunker(chunkerName); err != nil {
+		return err
+	}
+	r.SetDeltaGain(deltaGain)
+	r.SetDeltaCandidates(candidates)
+	r.SetMaxDeltaDepth(deltaDepth)
+	r.SetSpoolDir(spoolDir)
+	r.SetSkipUnchanged(skipUnchanged)
+	r.SetCheckpointInterval(checkpointInterval)
+	r.SetCheckpointRatio(checkpointRatio)
+	r.SetJobs(jobs)
 	r.Commit(source)
 	return nil
 }
@@ -128,7 +195,8 @@ func restoreMain(args []string) error {
 	}
 	source := args[0]
 	dest := args[1]
-	r := repo.NewRepo(source, chunkSize)
+	r := newRepo(source)
+	r.SetJobs(jobs)
 	r.Restore(dest)
 	return nil
 }
@@ -139,10 +207,11 @@ func exportMain(args []string) error {
 	}
 	source := args[0]
 	dest := args[1]
-	r := repo.NewRepo(source, chunkSize)
+	r := newRepo(source)
 	switch format {
 	case "dir":
 		exporter := dna.New(dest, poolCount, trackSize, tracksPerPool)
+		r.SetExportGroupSize(groupTracks * trackSize)
 		r.Export(exporter)
 	case "csv":
 		fmt.Println("not yet implemented")
@@ -22,6 +22,9 @@ import (
 	"fmt"
 	"io"
 	"path/filepath"
+
+	"github.com/n-peugnet/dna-backup/delta"
+	"github.com/n-peugnet/dna-backup/logger"
 )
 
 type Chunk interface {
@@ -60,6 +63,7 @@ func NewStoredChunk(repo *Repo, id *ChunkId) *StoredChunk {
 type StoredChunk struct {
 	repo *Repo
 	Id   *ChunkId
+	Size int // only set if it differs from the chunk size of the repo
 }
 
 func (c *StoredChunk) GetId() *ChunkId {
@@ -76,6 +80,9 @@ func (c *StoredChunk) Reader() io.ReadSeeker {
 }
 
 func (c *StoredChunk) Len() int {
+	if c.Size > 0 {
+		return c.Size
+	}
 	return c.repo.chunkSize
 }
 
@@ -107,11 +114,44 @@ func (c *TempChunk) AppendFrom(r io.Reader) {
 	c.Value = append(c.Value, buff...)
 }
 
+// PackedChunk is a part of a stored chunk, at the given offset. It is used for
+// the partial chunks stored with others in a pack (a shared chunk file of at
+// most the chunk size of the repo), and for the parts of the chunks at the
+// boundaries of a spliced recipe range.
+type PackedChunk struct {
+	repo   *Repo
+	Id     *ChunkId
+	Offset int
+	Size   int
+}
+
+func (c *PackedChunk) SetRepo(r *Repo) {
+	c.repo = r
+}
+
+func (c *PackedChunk) Reader() io.ReadSeeker {
+	return bytes.NewReader(c.content(c.repo.loadChunkBytes(c.Id)))
+}
+
+// content returns the content of the chunk from the one of its pack.
+func (c *PackedChunk) content(pack []byte) []byte {
+	if len(pack) < c.Offset+c.Size {
+		logger.Errorf("packed chunk out of pack %d of size %d", c.Id, len(pack))
+		return nil
+	}
+	return pack[c.Offset : c.Offset+c.Size]
+}
+
+func (c *PackedChunk) Len() int {
+	return c.Size
+}
+
 type DeltaChunk struct {
 	repo   *Repo
 	Source *ChunkId
 	Patch  []byte
 	Size   int
+	Codec  delta.CodecId
 }
 
 func (c *DeltaChunk) SetRepo(r *Repo) {
@@ -119,9 +159,22 @@ func (c *DeltaChunk) SetRepo(r *Repo) {
 }
 
 func (c *DeltaChunk) Reader() io.ReadSeeker {
-	var buff bytes.Buffer
-	c.repo.Patcher().Patch(c.repo.LoadChunkContent(c.Source), &buff, bytes.NewReader(c.Patch))
-	return bytes.NewReader(buff.Bytes())
+	return bytes.NewReader(c.content(c.repo.loadChunkBytes(c.Source)))
+}
+
+// content returns the content of the chunk from the one of its source.
+func (c *DeltaChunk) content(source []byte) []byte {
+	patcher, err := c.repo.codecPatcher(c.Codec)
+	if err != nil {
+		logger.Error("delta chunk ", err)
+		return nil
+	}
+	// the size of the result is known, so it is allocated only once
+	data, err := delta.PatchLimit(patcher, make([]byte, 0, c.Size), source, c.Patch, c.Size)
+	if err != nil {
+		logger.Error("delta chunk ", err)
+	}
+	return data
 }
 
 // TODO: Maybe return the size of the patch instead ?
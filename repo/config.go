@@ -0,0 +1,181 @@
+/* Copyright (C) 2021 Nicolas Peugnet <n.peugnet@free.fr>
+
+   This file is part of dna-backup.
+
+   dna-backup is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   dna-backup is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with dna-backup.  If not, see <https://www.gnu.org/licenses/>. */
+
+package repo
+
+import (
+	"encoding/gob"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/n-peugnet/dna-backup/chunker"
+	"github.com/n-peugnet/dna-backup/logger"
+	"github.com/n-peugnet/dna-backup/sketch"
+	"github.com/n-peugnet/dna-backup/utils"
+)
+
+// config holds the parameters used to write the versions of a repo. It is
+// stored at its root when the first version is created. The parameters of an
+// existing repo are then always loaded from it, so the ones that have been set
+// are only taken into account for new repos.
+//
+// Repos created before the config existed do not have one. Their versions have
+// been written with the legacy parameters, the default values of NewRepo, which
+// are thus used for them whatever has been set. Their config is stored by their
+// next commit, recording the number of these legacy versions, as their
+// metadata is not stored in the current formats.
+type config struct {
+	Compression      string
+	CompressionLevel int
+	DictionarySize   int
+	Sketcher         string
+	Chunker          string
+	LegacyVersions   int
+}
+
+// SetCompression selects the compression algorithm and its level. It is only
+// taken into account for new repos, as existing ones keep the algorithm stored
+// in their config.
+func (r *Repo) SetCompression(name string, level int) error {
+	_, write, err := utils.Compression(name, level)
+	if err != nil {
+		return err
+	}
+	id, err := utils.CompressionId(name)
+	if err != nil {
+		return err
+	}
+	r.compression = name
+	r.compressionLevel = level
+	r.chunkWriteWrapper = utils.TagWriter(id, write)
+	return nil
+}
+
+// decompressor returns the wrapper that decompresses data compressed with the
+// algorithm of the given ID, whatever the current compression of the repo is.
+func (r *Repo) decompressor(id byte) (utils.ReadWrapper, error) {
+	name, err := utils.CompressionName(id)
+	if err != nil {
+		return nil, err
+	}
+	if name == utils.CompressionZstd && len(r.dictionaries) > 0 {
+		return utils.ZstdDictReader(r.dictionaries...), nil
+	}
+	read, _, err := utils.Compression(name, 0)
+	return read, err
+}
+
+func (r *Repo) config() config {
+	return config{
+		Compression:      r.compression,
+		CompressionLevel: r.compressionLevel,
+		DictionarySize:   r.dictionarySize,
+		Sketcher:         r.sketcherName,
+		Chunker:          r.chunkerName,
+		LegacyVersions:   r.legacyVersions,
+	}
+}
+
+// legacyConfig returns the config of the versions created before the config
+// existed.
+func legacyConfig(versions int) config {
+	return config{
+		Compression:    utils.CompressionZlib,
+		Sketcher:       sketch.RegionName,
+		Chunker:        chunker.FixedName,
+		LegacyVersions: versions,
+	}
+}
+
+// loadConfig loads the config of the repo and applies it. If the repo is new,
+// the current config is stored instead. If it has versions but no config, the
+// legacy one is applied and will be stored by the next commit.
+func (r *Repo) loadConfig() {
+	path := filepath.Join(r.path, configName)
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		if len(r.versions) == 0 {
+			r.storeConfig(path)
+		} else {
+			logger.Infof("repo without config, using the legacy one for its %d versions", len(r.versions))
+			r.applyConfig(legacyConfig(len(r.versions)))
+			r.configMissing = true
+		}
+		return
+	} else if err != nil {
+		logger.Fatal(err)
+	}
+	var c config
+	if err = gob.NewDecoder(file).Decode(&c); err != nil {
+		logger.Panic("config ", err)
+	}
+	if err = file.Close(); err != nil {
+		logger.Warning(err)
+	}
+	if c.Sketcher == "" {
+		// configs written before the sketcher was selectable
+		c.Sketcher = sketch.RegionName
+	}
+	if c.Chunker == "" {
+		c.Chunker = chunker.FixedName
+	}
+	r.applyConfig(c)
+}
+
+// applyConfig sets the parameters of the repo to the ones of the given config.
+func (r *Repo) applyConfig(c config) {
+	var err error
+	r.legacyVersions = c.LegacyVersions
+	if c != r.config() {
+		logger.Infof("using repo compression %s (level %d)", c.Compression, c.CompressionLevel)
+		if err = r.SetCompression(c.Compression, c.CompressionLevel); err != nil {
+			logger.Fatal(err)
+		}
+		r.SetDictionarySize(c.DictionarySize)
+		if err = r.SetSketcher(c.Sketcher); err != nil {
+			logger.Fatal(err)
+		}
+		if err = r.SetChunker(c.Chunker); err != nil {
+			logger.Fatal(err)
+		}
+	}
+}
+
+// storeMissingConfig stores the config of a repo that has been created before
+// the config existed.
+func (r *Repo) storeMissingConfig() {
+	if r.configMissing {
+		logger.Info("store legacy config")
+		r.storeConfig(filepath.Join(r.path, configName))
+		r.configMissing = false
+	}
+}
+
+func (r *Repo) storeConfig(path string) {
+	file, err := os.Create(path)
+	if err != nil {
+		logger.Panic(err)
+	}
+	if err = gob.NewEncoder(file).Encode(r.config()); err != nil {
+		logger.Panic("config ", err)
+	}
+	if err = file.Close(); err != nil {
+		logger.Panic(err)
+	}
+}
@@ -7,4 +7,12 @@ const (
 	filesName  = "files"
 	hashesName = "hashes"
 	recipeName = "recipe"
+	inlineName = "inline"
+
+	dictionaryName = "dictionary"
+
+	configName    = "config"
+	keyParamsName = "keyparams"
+
+	snapshotExt = ".snapshot"
 )
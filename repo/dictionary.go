@@ -0,0 +1,130 @@
+/* Copyright (C) 2021 Nicolas Peugnet <n.peugnet@free.fr>
+
+   This file is part of dna-backup.
+
+   dna-backup is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   dna-backup is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with dna-backup.  If not, see <https://www.gnu.org/licenses/>. */
+
+package repo
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/n-peugnet/dna-backup/logger"
+	"github.com/n-peugnet/dna-backup/utils"
+)
+
+const (
+	// dictionaryIdBase is added to the version number to get the ID of the
+	// dictionary trained in this version. IDs below it are reserved by zstd.
+	dictionaryIdBase    = 32768
+	dictionaryMaxSample = 1000
+	dictionaryMinSample = 8
+)
+
+// SetDictionarySize enables the training of a zstd compression dictionary of
+// the given size for new repos using zstd. 0 disables it.
+func (r *Repo) SetDictionarySize(size int) {
+	r.dictionarySize = size
+}
+
+// loadDictionaries loads the compression dictionaries trained in each version.
+// They are all used for decompression, as each frame references the one it
+// has been compressed with, but only the last one is used for compression.
+func (r *Repo) loadDictionaries() {
+	r.dictionaries = nil
+	for _, v := range r.versions {
+		_, err := os.Stat(filepath.Join(v, dictionaryName))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		readDelta(v, dictionaryName, r.encryptionReadWrapper(), func(in io.ReadCloser) {
+			dict, err := io.ReadAll(in)
+			if err != nil {
+				logger.Panic("dictionary ", err)
+			}
+			r.dictionaries = append(r.dictionaries, dict)
+		})
+	}
+	r.applyDictionaries()
+}
+
+func (r *Repo) applyDictionaries() {
+	if len(r.dictionaries) == 0 || r.compression != utils.CompressionZstd {
+		return
+	}
+	dict := r.dictionaries[len(r.dictionaries)-1]
+	r.chunkWriteWrapper = utils.TagWriter(utils.CompressionZstdId, utils.ZstdDictWriter(r.compressionLevel, dict))
+}
+
+// trainDictionary trains a dictionary from a sample of the existing chunks if
+// it is enabled and none has been trained yet. It is then stored in the given
+// version and used from now on to compress chunks and metadata.
+func (r *Repo) trainDictionary(version int) {
+	if r.dictionarySize == 0 || r.compression != utils.CompressionZstd || len(r.dictionaries) > 0 {
+		return
+	}
+	samples := r.dictionarySamples()
+	if len(samples) < dictionaryMinSample {
+		logger.Infof("not enough chunks to train a dictionary: %d", len(samples))
+		return
+	}
+	logger.Infof("train dictionary from %d chunks", len(samples))
+	dict, err := utils.TrainZstdDict(uint32(dictionaryIdBase+version), samples, r.dictionarySize)
+	if err != nil {
+		logger.Warning("dictionary training ", err)
+		return
+	}
+	path := filepath.Join(r.path, fmt.Sprintf(versionFmt, version), dictionaryName)
+	file, err := os.Create(path)
+	if err != nil {
+		logger.Panic(err)
+	}
+	out := r.encryptionWriteWrapper()(file)
+	if _, err = out.Write(dict); err != nil {
+		logger.Panic("dictionary ", err)
+	}
+	if err = out.Close(); err != nil {
+		logger.Panic("dictionary ", err)
+	}
+	if err = file.Close(); err != nil {
+		logger.Panic(err)
+	}
+	r.dictionaries = append(r.dictionaries, dict)
+	r.applyDictionaries()
+}
+
+// dictionarySamples returns the content of chunks evenly spread among all the
+// chunks of the repo.
+func (r *Repo) dictionarySamples() (samples [][]byte) {
+	var chunks []IdentifiedChunk
+	for _, vc := range r.loadChunks(r.versions) {
+		chunks = append(chunks, vc...)
+	}
+	step := len(chunks)/dictionaryMaxSample + 1
+	for i := 0; i < len(chunks); i += step {
+		var buff bytes.Buffer
+		if _, err := buff.ReadFrom(chunks[i].Reader()); err != nil {
+			logger.Error("dictionary sample ", err)
+			continue
+		}
+		samples = append(samples, buff.Bytes())
+	}
+	return
+}
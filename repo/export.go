@@ -18,7 +18,11 @@
 package repo
 
 import (
+	"bytes"
+	"encoding/gob"
 	"io"
+	"os"
+	"path/filepath"
 
 	"github.com/n-peugnet/dna-backup/export"
 	"github.com/n-peugnet/dna-backup/logger"
@@ -31,9 +35,19 @@ func (r *Repo) Export(exporter export.Exporter) {
 	for i := range r.versions {
 		var err error
 		end := make(chan bool)
-		input := exporter.ExportVersion(end)
-		go exportChunks(chunks[i], r.chunkWriteWrapper, input.Chunks)
-		readDelta(r.versions[i], recipeName, utils.NopReadWrapper, func(rc io.ReadCloser) {
+		recipe, recipeSnapshot := metadataName(r.versions[i], recipeName)
+		files, filesSnapshot := metadataName(r.versions[i], filesName)
+		input := exporter.ExportVersion(export.Metadata{
+			RecipeSnapshot: recipeSnapshot,
+			FilesSnapshot:  filesSnapshot,
+		}, end)
+		var index exportIndex
+		if r.exportGroupSize > 0 {
+			index = exportGroups(chunks[i], r.writeWrapper(), r.exportGroupSize, input.Chunks)
+		} else {
+			go exportChunks(chunks[i], r.writeWrapper(), input.Chunks)
+		}
+		readDelta(r.versions[i], recipe, utils.NopReadWrapper, func(rc io.ReadCloser) {
 			_, err = io.Copy(input.Recipe, rc)
 			if err != nil {
 				logger.Error("load recipe ", err)
@@ -42,7 +56,7 @@ func (r *Repo) Export(exporter export.Exporter) {
 				logger.Error("export recipe ", err)
 			}
 		})
-		readDelta(r.versions[i], filesName, utils.NopReadWrapper, func(rc io.ReadCloser) {
+		readDelta(r.versions[i], files, utils.NopReadWrapper, func(rc io.ReadCloser) {
 			_, err = io.Copy(input.Files, rc)
 			if err != nil {
 				logger.Error("load files ", err)
@@ -51,10 +65,27 @@ func (r *Repo) Export(exporter export.Exporter) {
 				logger.Error("export files ", err)
 			}
 		})
+		exportDictionary(r.versions[i], input.Dictionary)
+		r.exportIndex(index, input.Index)
 		<-end
 	}
 }
 
+// exportDictionary exports the compression dictionary trained in the given
+// version if there is one, so that the exported data stays self-describing.
+func exportDictionary(version string, input io.WriteCloser) {
+	if _, err := os.Stat(filepath.Join(version, dictionaryName)); err == nil {
+		readDelta(version, dictionaryName, utils.NopReadWrapper, func(rc io.ReadCloser) {
+			if _, err = io.Copy(input, rc); err != nil {
+				logger.Error("load dictionary ", err)
+			}
+		})
+	}
+	if err := input.Close(); err != nil {
+		logger.Error("export dictionary ", err)
+	}
+}
+
 func exportChunks(chunks []IdentifiedChunk, wrapper utils.WriteWrapper, input io.WriteCloser) {
 	if len(chunks) > 0 {
 		compressed := wrapper(input)
@@ -68,3 +99,153 @@ func exportChunks(chunks []IdentifiedChunk, wrapper utils.WriteWrapper, input io
 	}
 	input.Close()
 }
+
+// SetExportGroupSize enables the compression of the exported chunks in
+// independent groups of the given size, which should be a multiple of the size
+// of a track. 0 disables it, all the chunks of a version then being compressed
+// at once.
+func (r *Repo) SetExportGroupSize(size int) {
+	r.exportGroupSize = size
+}
+
+// exportGroup is a group of consecutive chunks compressed together.
+type exportGroup struct {
+	First  int             // index of the first chunk of the group in its version
+	Size   int             // compressed size of the group, without its padding
+	Chunks []exportedChunk // position of each chunk in the decompressed group
+}
+
+// exportedChunk is the position of a chunk in the decompressed content of its
+// group, as chunks do not all have the same size.
+type exportedChunk struct {
+	Offset int
+	Length int
+}
+
+// exportIndex maps the exported chunks of a version to the group they have
+// been compressed in. The groups are written one after the other, each of
+// them being padded to a multiple of GroupSize.
+type exportIndex struct {
+	GroupSize int
+	Groups    []exportGroup
+}
+
+// Locate returns the group containing the chunk with the given index, the
+// offset of this group in the exported chunks and the position of the chunk in
+// the decompressed group.
+func (idx exportIndex) Locate(chunk int) (group int, offset int64, position exportedChunk) {
+	for i, g := range idx.Groups {
+		if i+1 < len(idx.Groups) && idx.Groups[i+1].First <= chunk {
+			offset += idx.paddedSize(g)
+			continue
+		}
+		return i, offset, g.Chunks[chunk-g.First]
+	}
+	return -1, 0, exportedChunk{}
+}
+
+func (idx exportIndex) paddedSize(g exportGroup) int64 {
+	count := (g.Size + idx.GroupSize - 1) / idx.GroupSize
+	return int64(count * idx.GroupSize)
+}
+
+// exportGroups compresses the chunks in independent groups, like EROFS does:
+// chunks are added to a group as long as its compressed size fits in groupSize.
+// Each group is then padded to groupSize, so that it can be read and
+// decompressed without reading the other ones. A chunk that does not fit alone
+// in a group is given a group padded to the next multiple of groupSize.
+//
+// As the compressed size cannot be known without compressing, the end of each
+// group is searched by compressing runs of chunks whose length is doubled while
+// they fit, then bisected, assuming that adding a chunk to a group never makes
+// it smaller. Each chunk is thus only compressed a logarithmic number of times
+// in the size of its group.
+func exportGroups(chunks []IdentifiedChunk, wrapper utils.WriteWrapper, groupSize int, input io.WriteCloser) exportIndex {
+	index := exportIndex{GroupSize: groupSize}
+	contents := make([][]byte, len(chunks))
+	load := func(first int, end int) [][]byte {
+		for i := first; i < end; i++ {
+			if contents[i] == nil {
+				var buff bytes.Buffer
+				if _, err := buff.ReadFrom(chunks[i].Reader()); err != nil {
+					logger.Error(err)
+				}
+				contents[i] = buff.Bytes()
+			}
+		}
+		return contents[first:end]
+	}
+	for first := 0; first < len(chunks); {
+		// the group [first, fit) fits, unless it only holds the first chunk,
+		// while the group [first, over) does not.
+		fit, over := first+1, len(chunks)+1
+		compressed := compressGroup(load(first, fit), wrapper)
+		if len(compressed) <= groupSize {
+			for step := 1; fit+step < over; step *= 2 {
+				candidate := compressGroup(load(first, fit+step), wrapper)
+				if len(candidate) > groupSize {
+					over = fit + step
+					break
+				}
+				fit, compressed = fit+step, candidate
+			}
+			for fit+1 < over {
+				middle := (fit + over) / 2
+				candidate := compressGroup(load(first, middle), wrapper)
+				if len(candidate) > groupSize {
+					over = middle
+				} else {
+					fit, compressed = middle, candidate
+				}
+			}
+		}
+		g := exportGroup{First: first, Size: len(compressed)}
+		var offset int
+		for i, content := range contents[first:fit] {
+			g.Chunks = append(g.Chunks, exportedChunk{offset, len(content)})
+			offset += len(content)
+			contents[first+i] = nil
+		}
+		index.Groups = append(index.Groups, g)
+		padding := make([]byte, index.paddedSize(g)-int64(g.Size))
+		if _, err := input.Write(append(compressed, padding...)); err != nil {
+			logger.Error("export group ", err)
+		}
+		first = fit
+	}
+	if err := input.Close(); err != nil {
+		logger.Error("export chunks ", err)
+	}
+	return index
+}
+
+func compressGroup(group [][]byte, wrapper utils.WriteWrapper) []byte {
+	var buff bytes.Buffer
+	out := wrapper(&buff)
+	for _, data := range group {
+		if _, err := out.Write(data); err != nil {
+			logger.Error("compress group ", err)
+		}
+	}
+	if err := out.Close(); err != nil {
+		logger.Error("compress group ", err)
+	}
+	return buff.Bytes()
+}
+
+// exportIndex exports the group index of a version, if its chunks have been
+// compressed in groups.
+func (r *Repo) exportIndex(index exportIndex, input io.WriteCloser) {
+	if len(index.Groups) > 0 {
+		out := r.writeWrapper()(input)
+		if err := gob.NewEncoder(out).Encode(index); err != nil {
+			logger.Error("export index ", err)
+		}
+		if err := out.Close(); err != nil {
+			logger.Error("export index ", err)
+		}
+	}
+	if err := input.Close(); err != nil {
+		logger.Error("export index ", err)
+	}
+}
@@ -0,0 +1,209 @@
+/* Copyright (C) 2021 Nicolas Peugnet <n.peugnet@free.fr>
+
+   This file is part of dna-backup.
+
+   dna-backup is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   dna-backup is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with dna-backup.  If not, see <https://www.gnu.org/licenses/>. */
+
+package repo
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io"
+
+	"github.com/n-peugnet/dna-backup/logger"
+	"github.com/n-peugnet/dna-backup/utils"
+)
+
+type fileOpKind uint8
+
+const (
+	fileKeep   fileOpKind = iota // keep the next Count entries of the previous list
+	fileDelete                   // drop the next Count entries of the previous list
+	fileInsert                   // insert a new entry
+	fileUpdate                   // replace the next entry of the previous list, keeping its path
+)
+
+// fileOp is a single operation of a structural file list delta.
+//
+// The path of an inserted entry is compressed: only the Suffix that differs
+// from the path of the entry preceding it in the resulting list is stored,
+// Prefix being the length of the part they share.
+type fileOp struct {
+	Kind    fileOpKind
+	Count   int
+	Prefix  int
+	Suffix  string
+	Size    int64
+	Link    string
+	Hash    []byte
+	ModTime int64
+	Inode   uint64
+}
+
+func (op fileOp) String() string {
+	switch op.Kind {
+	case fileKeep:
+		return fmt.Sprintf("= %d", op.Count)
+	case fileDelete:
+		return fmt.Sprintf("- %d", op.Count)
+	case fileInsert:
+		return fmt.Sprintf("+ %d %q %d %q %x %d %d", op.Prefix, op.Suffix, op.Size, op.Link, op.Hash, op.ModTime, op.Inode)
+	case fileUpdate:
+		return fmt.Sprintf("~ %d %q %x %d %d", op.Size, op.Link, op.Hash, op.ModTime, op.Inode)
+	}
+	return fmt.Sprintf("? %d", op.Kind)
+}
+
+// file returns the entry inserted or updated by op, at the given path.
+func (op fileOp) file(path string) File {
+	return File{Path: path, Size: op.Size, Link: op.Link, Hash: op.Hash, ModTime: op.ModTime, Inode: op.Inode}
+}
+
+func sameFile(a File, b File) bool {
+	return a.Path == b.Path && a.Size == b.Size && a.Link == b.Link && bytes.Equal(a.Hash, b.Hash) &&
+		a.ModTime == b.ModTime && a.Inode == b.Inode
+}
+
+func sharedPrefix(a string, b string) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
+
+// appendCountOp appends a keep or delete operation to ops, merging it with the
+// last one if they are of the same kind.
+func appendCountOp(ops []fileOp, kind fileOpKind, count int) []fileOp {
+	if len(ops) > 0 && ops[len(ops)-1].Kind == kind {
+		ops[len(ops)-1].Count += count
+		return ops
+	}
+	return append(ops, fileOp{Kind: kind, Count: count})
+}
+
+// diffFileLists produces the operations needed to transform prev into curr.
+//
+// Entries are matched by path. As both lists come from the same ordered walk of
+// the source, an entry found earlier in prev than the current position is
+// considered as new, which keeps the result small and deterministic.
+func diffFileLists(prev []File, curr []File) (ops []fileOp) {
+	index := make(map[string]int, len(prev))
+	for i, f := range prev {
+		index[f.Path] = i
+	}
+	var i int
+	var last string
+	for _, f := range curr {
+		if j, exists := index[f.Path]; exists && j >= i {
+			if j > i {
+				ops = appendCountOp(ops, fileDelete, j-i)
+			}
+			if sameFile(prev[j], f) {
+				ops = appendCountOp(ops, fileKeep, 1)
+			} else {
+				ops = append(ops, fileOp{
+					Kind:    fileUpdate,
+					Size:    f.Size,
+					Link:    f.Link,
+					Hash:    f.Hash,
+					ModTime: f.ModTime,
+					Inode:   f.Inode,
+				})
+			}
+			i = j + 1
+		} else {
+			prefix := sharedPrefix(last, f.Path)
+			ops = append(ops, fileOp{
+				Kind:    fileInsert,
+				Prefix:  prefix,
+				Suffix:  f.Path[prefix:],
+				Size:    f.Size,
+				Link:    f.Link,
+				Hash:    f.Hash,
+				ModTime: f.ModTime,
+				Inode:   f.Inode,
+			})
+		}
+		last = f.Path
+	}
+	if i < len(prev) {
+		ops = appendCountOp(ops, fileDelete, len(prev)-i)
+	}
+	return
+}
+
+// patchFileList applies the given operations to prev and returns the resulting
+// file list.
+func patchFileList(prev []File, ops []fileOp) (curr []File, err error) {
+	var i int
+	var last string
+	for _, op := range ops {
+		switch op.Kind {
+		case fileKeep:
+			if i+op.Count > len(prev) {
+				return nil, fmt.Errorf("file list keep %d out of range", op.Count)
+			}
+			curr = append(curr, prev[i:i+op.Count]...)
+			i += op.Count
+		case fileDelete:
+			if i+op.Count > len(prev) {
+				return nil, fmt.Errorf("file list delete %d out of range", op.Count)
+			}
+			i += op.Count
+			continue
+		case fileInsert:
+			if op.Prefix > len(last) {
+				return nil, fmt.Errorf("file list prefix %d out of range", op.Prefix)
+			}
+			curr = append(curr, op.file(last[:op.Prefix]+op.Suffix))
+		case fileUpdate:
+			if i >= len(prev) {
+				return nil, fmt.Errorf("file list update out of range")
+			}
+			curr = append(curr, op.file(prev[i].Path))
+			i++
+		default:
+			return nil, fmt.Errorf("unknown file list operation %d", op.Kind)
+		}
+		last = curr[len(curr)-1].Path
+	}
+	if i != len(prev) {
+		return nil, fmt.Errorf("file list has %d unprocessed entries", len(prev)-i)
+	}
+	return
+}
+
+func (r *Repo) encodeFileOps(ops []fileOp) []byte {
+	var buff bytes.Buffer
+	out := r.writeWrapper()(&buff)
+	if err := gob.NewEncoder(out).Encode(ops); err != nil {
+		logger.Panic(err)
+	}
+	if err := out.Close(); err != nil {
+		logger.Panic(err)
+	}
+	return buff.Bytes()
+}
+
+func loadFileOps(version string, name string, wrapper utils.ReadWrapper) (ops []fileOp) {
+	readDelta(version, name, wrapper, func(in io.ReadCloser) {
+		if err := gob.NewDecoder(in).Decode(&ops); err != nil {
+			logger.Panic(err)
+		}
+	})
+	return
+}
@@ -0,0 +1,69 @@
+/* Copyright (C) 2021 Nicolas Peugnet <n.peugnet@free.fr>
+
+   This file is part of dna-backup.
+
+   dna-backup is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   dna-backup is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with dna-backup.  If not, see <https://www.gnu.org/licenses/>. */
+
+package repo
+
+import (
+	"testing"
+
+	"github.com/n-peugnet/dna-backup/testutils"
+)
+
+func TestFileListDelta(t *testing.T) {
+	prev := []File{
+		{Path: "/a/1", Size: 10},
+		{Path: "/a/2", Size: 20},
+		{Path: "/b/1", Size: 30},
+		{Path: "/b/2", Size: 40},
+		{Path: "/c", Size: 0, Link: "/a/1"},
+	}
+	curr := []File{
+		{Path: "/a/1", Size: 10},
+		{Path: "/a/2", Size: 21, Hash: []byte{1}},
+		{Path: "/a/3", Size: 30},
+		{Path: "/b/2", Size: 40},
+		{Path: "/c", Size: 0, Link: "/a/1"},
+		{Path: "/d/e/f", Size: 50},
+	}
+	expected := []fileOp{
+		{Kind: fileKeep, Count: 1},
+		{Kind: fileUpdate, Size: 21, Hash: []byte{1}},
+		{Kind: fileInsert, Prefix: 3, Suffix: "3", Size: 30},
+		{Kind: fileDelete, Count: 1},
+		{Kind: fileKeep, Count: 2},
+		{Kind: fileInsert, Prefix: 1, Suffix: "d/e/f", Size: 50},
+	}
+	ops := diffFileLists(prev, curr)
+	testutils.AssertSame(t, expected, ops, "Operations")
+	actual, err := patchFileList(prev, ops)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutils.AssertSame(t, curr, actual, "Patched list")
+
+	ops = diffFileLists(curr, nil)
+	testutils.AssertSame(t, []fileOp{{Kind: fileDelete, Count: len(curr)}}, ops, "Delete all")
+	actual, err = patchFileList(curr, ops)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutils.AssertLen(t, 0, actual, "Empty list")
+
+	if _, err = patchFileList(prev, []fileOp{{Kind: fileKeep, Count: 1}}); err == nil {
+		t.Error("incomplete operations should return an error")
+	}
+}
@@ -0,0 +1,156 @@
+/* Copyright (C) 2021 Nicolas Peugnet <n.peugnet@free.fr>
+
+   This file is part of dna-backup.
+
+   dna-backup is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   dna-backup is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with dna-backup.  If not, see <https://www.gnu.org/licenses/>. */
+
+package repo
+
+import (
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/chmduquesne/rollinghash/rabinkarp64"
+	"github.com/n-peugnet/dna-backup/encryption"
+	"github.com/n-peugnet/dna-backup/logger"
+	"github.com/n-peugnet/dna-backup/utils"
+)
+
+const (
+	polynomialLabel = "dna-backup rolling hash polynomial"
+	strongHashLabel = "dna-backup strong hash"
+)
+
+// SetSecret sets the passphrase or key file content used to derive the key of
+// the repo.
+// If the repo does not have any version yet, setting a secret enables its
+// encryption.
+func (r *Repo) SetSecret(secret []byte) {
+	r.secret = secret
+}
+
+// loadKey derives the key of the repo from its secret using the stored key
+// parameters. If the repo is new and a secret has been given, new parameters
+// are generated and stored.
+func (r *Repo) loadKey() {
+	if r.key != nil {
+		return
+	}
+	path := filepath.Join(r.path, keyParamsName)
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		if r.secret == nil {
+			return
+		}
+		if len(r.versions) > 0 {
+			logger.Fatal("cannot enable encryption on a repo that already has versions")
+		}
+		r.storeKeyParams(path)
+		return
+	} else if err != nil {
+		logger.Fatal(err)
+	}
+	var params encryption.Params
+	if err = gob.NewDecoder(file).Decode(&params); err != nil {
+		logger.Panic("key params ", err)
+	}
+	if err = file.Close(); err != nil {
+		logger.Warning(err)
+	}
+	if r.secret == nil {
+		logger.Fatal("repo is encrypted, a passphrase or key file is required")
+	}
+	if r.key, err = params.Key(r.secret); err != nil {
+		logger.Fatal(err)
+	}
+	r.initKeyedHashes()
+}
+
+// initKeyedHashes makes the fingerprints, sketches and strong hashes of an
+// encrypted repo depend on its key, so that they do not allow to confirm the
+// presence of a known content.
+//
+// The rolling hash polynomial is chosen using a seed derived from the key and
+// the strong hash becomes an HMAC.
+func (r *Repo) initKeyedHashes() {
+	seed := encryption.SubKey(r.key, polynomialLabel)
+	pol, err := rabinkarp64.RandomPolynomial(int64(binary.LittleEndian.Uint64(seed)))
+	if err != nil {
+		logger.Panic(err)
+	}
+	r.pol = pol
+	r.sketcher = nil
+	r.cdc = nil
+	r.hashKey = encryption.SubKey(r.key, strongHashLabel)
+}
+
+func (r *Repo) storeKeyParams(path string) {
+	params, key, err := encryption.NewParams(r.secret)
+	if err != nil {
+		logger.Panic("key params ", err)
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		logger.Panic(err)
+	}
+	if err = gob.NewEncoder(file).Encode(params); err != nil {
+		logger.Panic("key params ", err)
+	}
+	if err = file.Close(); err != nil {
+		logger.Panic(err)
+	}
+	logger.Info("repo encryption enabled")
+	r.key = key
+	r.initKeyedHashes()
+}
+
+// encryptionReadWrapper returns the wrapper that only decrypts data if the repo
+// is encrypted.
+func (r *Repo) encryptionReadWrapper() utils.ReadWrapper {
+	if r.key == nil {
+		return utils.NopReadWrapper
+	}
+	return encryption.ReadWrapper(r.key)
+}
+
+// encryptionWriteWrapper returns the wrapper that only encrypts data if the repo
+// is encrypted.
+func (r *Repo) encryptionWriteWrapper() utils.WriteWrapper {
+	if r.key == nil {
+		return utils.NopWriteWrapper
+	}
+	return encryption.WriteWrapper(r.key)
+}
+
+// readWrapper returns the wrapper used to read the data files of the repo. They
+// are decrypted if the repo is encrypted, then decompressed.
+func (r *Repo) readWrapper() utils.ReadWrapper {
+	if r.key == nil {
+		return r.chunkReadWrapper
+	}
+	return utils.ChainReadWrappers(encryption.ReadWrapper(r.key), r.chunkReadWrapper)
+}
+
+// writeWrapper returns the wrapper used to write the data files of the repo.
+// They are compressed, then encrypted if the repo is encrypted.
+func (r *Repo) writeWrapper() utils.WriteWrapper {
+	if r.key == nil {
+		return r.chunkWriteWrapper
+	}
+	return utils.ChainWriteWrappers(encryption.WriteWrapper(r.key), r.chunkWriteWrapper)
+}
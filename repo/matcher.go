@@ -0,0 +1,371 @@
+/* Copyright (C) 2021 Nicolas Peugnet <n.peugnet@free.fr>
+
+   This file is part of dna-backup.
+
+   dna-backup is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   dna-backup is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with dna-backup.  If not, see <https://www.gnu.org/licenses/>. */
+
+package repo
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"reflect"
+
+	"github.com/chmduquesne/rollinghash/rabinkarp64"
+	"github.com/n-peugnet/dna-backup/chunker"
+	"github.com/n-peugnet/dna-backup/logger"
+)
+
+// Matcher splits a stream into chunks and matches them against the chunks of a
+// ChunkStore. It returns the recipe of the stream: the list of its chunks.
+type Matcher interface {
+	Match(stream io.Reader, store ChunkStore) []Chunk
+}
+
+// ChunkStore is what a Matcher needs from the repo during a commit.
+type ChunkStore interface {
+	// Find returns the stored chunk with the given fingerprint and content, or
+	// nil if there is none.
+	Find(fp uint64, content []byte) Chunk
+	// Encode encodes a new chunk, either as a delta of a similar stored chunk,
+	// or as a new stored chunk if it is full. Otherwise, it is returned as is.
+	// The encoding can be asynchronous, in which case the returned chunk can
+	// only be read once the whole stream has been matched.
+	Encode(temp BufferedChunk) Chunk
+	// EncodeDelta is like Encode, but it waits for the encoding. The returned
+	// boolean is true if the chunk has been delta-encoded.
+	EncodeDelta(temp BufferedChunk) (Chunk, bool)
+}
+
+// commitStore is the ChunkStore of a commit. New chunks are attributed the
+// next ids of the version and sent to the store worker through the queue.
+//
+// If the repo has several jobs, the encodings of the new chunks are prepared by
+// as many workers at once. They are then finished in the order of the stream by
+// the matcher goroutine, so that the result does not depend on the number of
+// workers: Encode returns a pendingChunk that is resolved later on.
+type commitStore struct {
+	repo    *Repo
+	version int
+	last    uint64
+	queue   chan<- chunkData
+	workers chan bool       // limits the number of running workers
+	pending []*pendingChunk // chunks being encoded, in the order of the stream
+	fps     map[uint64]int  // fingerprints of the full pending chunks
+}
+
+// pendingChunk is the placeholder of a chunk being encoded in a recipe.
+type pendingChunk struct {
+	temp     BufferedChunk
+	fp       uint64
+	full     bool
+	encoding *tempEncoding
+	prepared chan bool
+	chunk    Chunk
+}
+
+func (c *pendingChunk) Reader() io.ReadSeeker {
+	return c.chunk.Reader()
+}
+
+func (c *pendingChunk) Len() int {
+	return c.temp.Len()
+}
+
+func (s *commitStore) Find(fp uint64, content []byte) Chunk {
+	if s.fps[fp] > 0 {
+		// a pending chunk could be stored with this fingerprint
+		s.resolve(len(s.pending))
+	}
+	id, exists := s.repo.fingerprints[fp]
+	if !exists || !s.repo.confirmMatch(id, content) {
+		return nil
+	}
+	logger.Debugf("add existing chunk: %d", id)
+	return s.repo.newStoredChunk(id, len(content))
+}
+
+func (s *commitStore) Encode(temp BufferedChunk) Chunk {
+	if s.repo.jobs <= 1 {
+		c, _ := s.EncodeDelta(temp)
+		return c
+	}
+	if s.workers == nil {
+		s.repo.chunkSketcher()
+		s.workers = make(chan bool, s.repo.jobs)
+		s.fps = make(map[uint64]int)
+	}
+	c := &pendingChunk{temp: temp, full: s.repo.isFullChunk(temp.Len()), prepared: make(chan bool)}
+	if c.full {
+		c.fp = s.repo.fingerprint(temp.Bytes())
+		s.fps[c.fp]++
+	}
+	s.pending = append(s.pending, c)
+	go func() {
+		s.workers <- true
+		c.encoding = s.repo.prepareTempChunk(temp, c.fp, &[2][]byte{})
+		<-s.workers
+		close(c.prepared)
+	}()
+	// bound the memory used by the chunks waiting to be resolved
+	for len(s.pending) > 4*s.repo.jobs {
+		s.resolve(1)
+	}
+	return c
+}
+
+func (s *commitStore) EncodeDelta(temp BufferedChunk) (Chunk, bool) {
+	s.resolve(len(s.pending))
+	var fp uint64
+	if s.repo.isFullChunk(temp.Len()) {
+		fp = s.repo.fingerprint(temp.Bytes())
+	}
+	e := s.repo.prepareTempChunk(temp, fp, &s.repo.deltaBuffers)
+	return s.repo.encodeTempChunk(temp, e, s.version, &s.last, s.queue)
+}
+
+// resolve finishes the encoding of the first n pending chunks.
+func (s *commitStore) resolve(n int) {
+	for _, c := range s.pending[:n] {
+		<-c.prepared
+		c.chunk, _ = s.repo.encodeTempChunk(c.temp, c.encoding, s.version, &s.last, s.queue)
+		if c.full {
+			if s.fps[c.fp]--; s.fps[c.fp] == 0 {
+				delete(s.fps, c.fp)
+			}
+		}
+	}
+	s.pending = s.pending[n:]
+}
+
+// finish is called once the stream has been matched. It resolves the pending
+// chunks of the given recipe.
+func (s *commitStore) finish(recipe []Chunk) []Chunk {
+	s.resolve(len(s.pending))
+	for i, c := range recipe {
+		if p, isPending := c.(*pendingChunk); isPending {
+			recipe[i] = p.chunk
+		}
+	}
+	return recipe
+}
+
+// SetMatcher replaces the matcher selected by the chunker of the repo.
+func (r *Repo) SetMatcher(m Matcher) {
+	r.matcher = m
+}
+
+// streamMatcher returns the matcher used to commit a new version.
+func (r *Repo) streamMatcher() Matcher {
+	if r.matcher != nil {
+		return r.matcher
+	}
+	if r.chunkerName == chunker.FastCDCName {
+		return &CDCMatcher{Pol: r.pol, Chunker: r.contentChunker()}
+	}
+	return &FixedMatcher{Pol: r.pol, ChunkSize: r.chunkSize, MinLen: r.chunkMinLen()}
+}
+
+// SetSpoolDir sets the directory where the source stream is spooled during a
+// commit. By default, the temporary directory of the system is used.
+func (r *Repo) SetSpoolDir(dir string) {
+	r.spoolDir = dir
+}
+
+// matchSource matches the given source stream until no new chunks are found.
+// As the new chunks of a pass can be matched by the next one, several passes
+// can be needed to reach a fixed point. To read the source only once, it is
+// spooled to a temporary file during the first pass, which is then read by the
+// next ones. The partial chunks of the final recipe are then packed.
+func (r *Repo) matchSource(source io.Reader, store *commitStore) []Chunk {
+	matcher := r.streamMatcher()
+	spool, err := os.CreateTemp(r.spoolDir, "dna-backup-spool-")
+	if err != nil {
+		logger.Panic(err)
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+	spoolWriter := bufio.NewWriter(spool)
+	var last, pass uint64
+	var recipe []Chunk
+	for ; store.last > last || pass == 0; pass++ {
+		logger.Infof("matcher pass number %d", pass+1)
+		last = store.last
+		if pass == 0 {
+			recipe = store.finish(matcher.Match(io.TeeReader(source, spoolWriter), store))
+			// the source must be fully read for the next passes
+			if _, err = io.Copy(spoolWriter, source); err != nil {
+				logger.Panic("spool ", err)
+			}
+			if err = spoolWriter.Flush(); err != nil {
+				logger.Panic("spool ", err)
+			}
+			continue
+		}
+		if _, err = spool.Seek(0, io.SeekStart); err != nil {
+			logger.Panic("spool ", err)
+		}
+		recipe = store.finish(matcher.Match(spool, store))
+	}
+	r.storePacks(recipe, store.version, &store.last, store.queue)
+	return recipe
+}
+
+// FixedMatcher matches fixed size chunks at any position of the stream using a
+// rolling hash. Unmatched data smaller than MinLen is merged with the previous
+// unmatched chunk before trying to delta-encode it.
+type FixedMatcher struct {
+	Pol       rabinkarp64.Pol
+	ChunkSize int
+	MinLen    int
+}
+
+// encodeTempChunks encodes the current temporary chunks based on the value of the previous one.
+// Temporary chunks can be partial. If the current chunk is smaller than the size of a
+// super-feature and there exists a previous chunk, then both are merged before attempting
+// to delta-encode them.
+func (m *FixedMatcher) encodeTempChunks(prev BufferedChunk, curr BufferedChunk, store ChunkStore) []Chunk {
+	if reflect.ValueOf(prev).IsNil() {
+		return []Chunk{store.Encode(curr)}
+	} else if curr.Len() < m.MinLen {
+		tmp := NewTempChunk(append(prev.Bytes(), curr.Bytes()...))
+		c, success := store.EncodeDelta(tmp)
+		if success {
+			return []Chunk{c}
+		}
+	}
+	return []Chunk{store.Encode(prev), store.Encode(curr)}
+}
+
+// Match is the heart of DNA-backup. Thus, it sounded rude not to add some comment to it.
+//
+// It applies a rolling hash on the content of a given stream to look for matching fingerprints
+// in the store. If no match is found after the equivalent of three chunks of data are processed,
+// then the first unmatched chunk sketch is checked to see if it could be delta-encoded.
+// If not, the chunk is then stored as a new chunk by the store.
+//
+// If a match happens during the processing of the third chunk, then, if possible, the remaining
+// of the second chunk is merged with the first one to try to delta encode it at once.
+func (m *FixedMatcher) Match(stream io.Reader, store ChunkStore) []Chunk {
+	var b byte
+	var chunks []Chunk
+	var prev *TempChunk
+	var err error
+	bufStream := bufio.NewReaderSize(stream, m.ChunkSize*2)
+	buff := make([]byte, m.ChunkSize, m.ChunkSize*2)
+	if n, err := io.ReadFull(stream, buff); n < m.ChunkSize {
+		if err == io.EOF {
+			return chunks // empty stream
+		} else if err == io.ErrUnexpectedEOF {
+			c := store.Encode(NewTempChunk(buff[:n]))
+			chunks = append(chunks, c)
+			return chunks
+		} else {
+			logger.Panicf("matching stream, read only %d bytes with error '%s'", n, err)
+		}
+	}
+	hasher := rabinkarp64.NewFromPol(m.Pol)
+	hasher.Write(buff)
+	for err != io.EOF {
+		h := hasher.Sum64()
+		if stored := store.Find(h, buff[len(buff)-m.ChunkSize:]); stored != nil {
+			if len(buff) > m.ChunkSize && len(buff) <= m.ChunkSize*2 {
+				size := len(buff) - m.ChunkSize
+				temp := NewTempChunk(buff[:size])
+				chunks = append(chunks, m.encodeTempChunks(prev, temp, store)...)
+				prev = nil
+			} else if prev != nil {
+				c := store.Encode(prev)
+				chunks = append(chunks, c)
+				prev = nil
+			}
+			chunks = append(chunks, stored)
+			buff = make([]byte, 0, m.ChunkSize*2)
+			for i := 0; i < m.ChunkSize && err == nil; i++ {
+				b, err = bufStream.ReadByte()
+				if err != io.EOF {
+					hasher.Roll(b)
+					buff = append(buff, b)
+				}
+			}
+			continue
+		}
+		if len(buff) == m.ChunkSize*2 {
+			if prev != nil {
+				chunk := store.Encode(prev)
+				chunks = append(chunks, chunk)
+			}
+			prev = NewTempChunk(buff[:m.ChunkSize])
+			tmp := buff[m.ChunkSize:]
+			buff = make([]byte, m.ChunkSize, m.ChunkSize*2)
+			copy(buff, tmp)
+		}
+		b, err = bufStream.ReadByte()
+		if err != io.EOF {
+			hasher.Roll(b)
+			buff = append(buff, b)
+		}
+	}
+	if len(buff) > 0 {
+		var temp *TempChunk
+		if len(buff) > m.ChunkSize {
+			if prev != nil {
+				chunk := store.Encode(prev)
+				chunks = append(chunks, chunk)
+			}
+			prev = NewTempChunk(buff[:m.ChunkSize])
+			temp = NewTempChunk(buff[m.ChunkSize:])
+		} else {
+			temp = NewTempChunk(buff)
+		}
+		chunks = append(chunks, m.encodeTempChunks(prev, temp, store)...)
+	}
+	return chunks
+}
+
+// CDCMatcher matches the content-defined chunks produced by its Chunker. As
+// their boundaries only depend on their content, no rolling hash is needed.
+type CDCMatcher struct {
+	Pol     rabinkarp64.Pol
+	Chunker *chunker.FastCDC
+}
+
+// Match cuts the stream into chunks that are either found in the store using
+// their fingerprint, or encoded as new chunks.
+func (m *CDCMatcher) Match(stream io.Reader, store ChunkStore) []Chunk {
+	var chunks []Chunk
+	cdc := m.Chunker
+	bufStream := bufio.NewReaderSize(stream, cdc.Max)
+	for {
+		data, err := bufStream.Peek(cdc.Max)
+		if err != nil && err != io.EOF {
+			logger.Panic("matching stream ", err)
+		}
+		if len(data) == 0 {
+			return chunks
+		}
+		content := make([]byte, cdc.Cut(data))
+		copy(content, data)
+		bufStream.Discard(len(content))
+		hasher := rabinkarp64.NewFromPol(m.Pol)
+		hasher.Write(content)
+		if stored := store.Find(hasher.Sum64(), content); stored != nil {
+			chunks = append(chunks, stored)
+			continue
+		}
+		c := store.Encode(NewTempChunk(content))
+		chunks = append(chunks, c)
+	}
+}
@@ -0,0 +1,254 @@
+/* Copyright (C) 2021 Nicolas Peugnet <n.peugnet@free.fr>
+
+   This file is part of dna-backup.
+
+   dna-backup is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   dna-backup is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with dna-backup.  If not, see <https://www.gnu.org/licenses/>. */
+
+package repo
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/chmduquesne/rollinghash/rabinkarp64"
+	"github.com/n-peugnet/dna-backup/chunker"
+	"github.com/n-peugnet/dna-backup/logger"
+	"github.com/n-peugnet/dna-backup/testutils"
+)
+
+// mapStore is an in memory ChunkStore without delta encoding, that stores the
+// chunks of at least minLen bytes.
+type mapStore struct {
+	pol          rabinkarp64.Pol
+	minLen       int
+	fingerprints map[uint64]*ChunkId
+	contents     map[ChunkId][]byte
+}
+
+func newMapStore(pol rabinkarp64.Pol, minLen int) *mapStore {
+	return &mapStore{
+		pol:          pol,
+		minLen:       minLen,
+		fingerprints: make(map[uint64]*ChunkId),
+		contents:     make(map[ChunkId][]byte),
+	}
+}
+
+func (s *mapStore) Find(fp uint64, content []byte) Chunk {
+	id, exists := s.fingerprints[fp]
+	if !exists || !bytes.Equal(s.contents[*id], content) {
+		return nil
+	}
+	return &StoredChunk{Id: id, Size: len(content)}
+}
+
+func (s *mapStore) Encode(temp BufferedChunk) Chunk {
+	c, _ := s.EncodeDelta(temp)
+	return c
+}
+
+func (s *mapStore) EncodeDelta(temp BufferedChunk) (Chunk, bool) {
+	if temp.Len() < s.minLen {
+		return temp, false
+	}
+	id := &ChunkId{Idx: uint64(len(s.contents))}
+	hasher := rabinkarp64.NewFromPol(s.pol)
+	hasher.Write(temp.Bytes())
+	s.fingerprints[hasher.Sum64()] = id
+	s.contents[*id] = append([]byte{}, temp.Bytes()...)
+	return &StoredChunk{Id: id, Size: temp.Len()}, false
+}
+
+// content rebuilds the content of a recipe made with this store.
+func (s *mapStore) content(recipe []Chunk) []byte {
+	var content []byte
+	for _, c := range recipe {
+		switch c := c.(type) {
+		case *StoredChunk:
+			content = append(content, s.contents[*c.Id]...)
+		case *TempChunk:
+			content = append(content, c.Value...)
+		}
+	}
+	return content
+}
+
+func randomBytes(rand *rand.Rand, size int) []byte {
+	data := make([]byte, size)
+	rand.Read(data)
+	return data
+}
+
+func TestFixedMatcher(t *testing.T) {
+	pol, _ := rabinkarp64.RandomPolynomial(1)
+	rand := rand.New(rand.NewSource(1))
+	matcher := &FixedMatcher{Pol: pol, ChunkSize: 256, MinLen: 64}
+	store := newMapStore(pol, matcher.ChunkSize)
+	a := randomBytes(rand, matcher.ChunkSize)
+	b := randomBytes(rand, matcher.ChunkSize)
+	var data []byte
+	for _, part := range [][]byte{a, b, a, []byte("shift"), b, a[:100]} {
+		data = append(data, part...)
+	}
+	// as new chunks are stored with some delay, several passes are needed to
+	// match all of them, like in Commit
+	var recipe []Chunk
+	for count := -1; count != len(store.contents); {
+		count = len(store.contents)
+		recipe = matcher.Match(bytes.NewReader(data), store)
+	}
+	testutils.AssertSame(t, data, store.content(recipe), "Matched content")
+	testutils.AssertLen(t, 6, recipe, "Recipe")
+	testutils.AssertSame(t, NewTempChunk([]byte("shift")), recipe[3], "Shifted chunk")
+}
+
+func TestCDCMatcher(t *testing.T) {
+	pol, _ := rabinkarp64.RandomPolynomial(1)
+	rand := rand.New(rand.NewSource(1))
+	matcher := &CDCMatcher{Pol: pol, Chunker: chunker.NewFastCDC(1, 256, 1<<10, 4<<10)}
+	store := newMapStore(pol, matcher.Chunker.Min)
+	data := randomBytes(rand, 64<<10)
+	first := matcher.Match(bytes.NewReader(data), store)
+	testutils.AssertSame(t, data, store.content(first), "Matched content")
+	count := len(store.contents)
+
+	pos := len(data) / 2
+	modified := append(append(append([]byte{}, data[:pos]...), "inserted"...), data[pos:]...)
+	second := matcher.Match(bytes.NewReader(modified), store)
+	testutils.AssertSame(t, modified, store.content(second), "Matched content")
+	if added := len(store.contents) - count; added > 2 {
+		t.Errorf("%d chunks have been added after an insertion", added)
+	}
+}
+
+// countingReader counts the bytes read from its reader.
+type countingReader struct {
+	io.Reader
+	count int
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.count += n
+	return n, err
+}
+
+// describe returns a representation of a recipe that does not depend on its
+// repo.
+func describe(recipe []Chunk) (ret []string) {
+	for _, c := range recipe {
+		switch c := c.(type) {
+		case *StoredChunk:
+			ret = append(ret, fmt.Sprintf("stored %v", *c.Id))
+		case *DeltaChunk:
+			ret = append(ret, fmt.Sprintf("delta %v %d", *c.Source, c.Size))
+		case *PackedChunk:
+			ret = append(ret, fmt.Sprintf("packed %v %d %d", *c.Id, c.Offset, c.Size))
+		default:
+			ret = append(ret, fmt.Sprintf("temp %d", c.Len()))
+		}
+	}
+	return
+}
+
+func TestMatchSource(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	rand := rand.New(rand.NewSource(1))
+	a := randomBytes(rand, 8<<10)
+	b := randomBytes(rand, 8<<10)
+	var data []byte
+	for _, part := range [][]byte{a, b, a, []byte("shift"), b, a[:100]} {
+		data = append(data, part...)
+	}
+	commit := func(match func(r *Repo, store *commitStore) []Chunk) []Chunk {
+		repo := NewRepo(t.TempDir(), 8<<10)
+		queue := make(chan chunkData, 16)
+		go func() {
+			for range queue {
+			}
+		}()
+		defer close(queue)
+		return match(repo, &commitStore{repo: repo, version: 0, queue: queue})
+	}
+
+	// previous behaviour: the source is read again for each pass
+	var reads int
+	expected := commit(func(r *Repo, store *commitStore) (recipe []Chunk) {
+		for last := ^uint64(0); store.last != last; reads++ {
+			last = store.last
+			recipe = store.finish(r.streamMatcher().Match(bytes.NewReader(data), store))
+		}
+		r.storePacks(recipe, store.version, &store.last, store.queue)
+		return
+	})
+	if reads < 2 {
+		t.Fatalf("the data should need several passes, not %d", reads)
+	}
+	source := &countingReader{Reader: bytes.NewReader(data)}
+	actual := commit(func(r *Repo, store *commitStore) []Chunk {
+		return r.matchSource(source, store)
+	})
+	testutils.AssertSame(t, describe(expected), describe(actual), "Recipe")
+	testutils.AssertSame(t, len(data), source.count, "Bytes read from the source")
+}
+
+func TestMatchSourcePacks(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	rand := rand.New(rand.NewSource(1))
+	a := randomBytes(rand, 8<<10)
+	b := randomBytes(rand, 8<<10)
+	var data []byte
+	// a partial chunk of the first pass is not part of the final recipe
+	for _, part := range [][]byte{a, []byte("shift"), a, []byte("shift"), b} {
+		data = append(data, part...)
+	}
+	repo := NewRepo(t.TempDir(), 8<<10)
+	queue := make(chan chunkData, 16)
+	var stored []*ChunkId
+	end := make(chan bool)
+	go func() {
+		for c := range queue {
+			stored = append(stored, c.id)
+		}
+		end <- true
+	}()
+	recipe := repo.matchSource(bytes.NewReader(data), &commitStore{repo: repo, version: 0, queue: queue})
+	close(queue)
+	<-end
+
+	// the packs of the partial chunks of the previous passes must not be stored
+	referenced := make(map[ChunkId]bool)
+	var packed int
+	for _, c := range recipe {
+		if _, isPacked := c.(*PackedChunk); isPacked {
+			packed++
+		}
+		if base := chunkBase(c); base != nil {
+			referenced[*base] = true
+		}
+	}
+	if packed == 0 {
+		t.Fatal("recipe should contain packed chunks")
+	}
+	for _, id := range stored {
+		if !referenced[*id] {
+			t.Errorf("stored chunk %v should be referenced by the recipe", *id)
+		}
+	}
+}
@@ -30,6 +30,7 @@ repo/
 │   │   └── 000000000000003
 │   ├── files
 │   ├── hashes
+│   ├── inline
 │   └── recipe
 └── 00001/
     ├── chunks/
@@ -37,6 +38,7 @@ repo/
     │   └── 000000000000001
     ├── files
     ├── hashes
+    ├── inline
     └── recipe
 ```
 */
@@ -46,18 +48,24 @@ package repo
 import (
 	"bufio"
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
 	"encoding/gob"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
-	"reflect"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/chmduquesne/rollinghash/rabinkarp64"
 	"github.com/n-peugnet/dna-backup/cache"
+	"github.com/n-peugnet/dna-backup/chunker"
 	"github.com/n-peugnet/dna-backup/delta"
 	"github.com/n-peugnet/dna-backup/logger"
 	"github.com/n-peugnet/dna-backup/sketch"
@@ -69,11 +77,13 @@ func init() {
 	gob.RegisterName("*dna-backup.StoredChunk", &StoredChunk{})
 	gob.RegisterName("*dna-backup.TempChunk", &TempChunk{})
 	gob.RegisterName("*dna-backup.DeltaChunk", &DeltaChunk{})
+	gob.RegisterName("*dna-backup.PackedChunk", &PackedChunk{})
 	gob.RegisterName("dna-backup.File", File{})
 }
 
 type FingerprintMap map[uint64]*ChunkId
 type SketchMap map[uint64][]*ChunkId
+type StrongHashMap map[ChunkId][]byte
 
 func (m SketchMap) Set(key []uint64, value *ChunkId) {
 	for _, s := range key {
@@ -86,29 +96,100 @@ func (m SketchMap) Set(key []uint64, value *ChunkId) {
 }
 
 type Repo struct {
-	path              string
-	versions          []string
-	chunkSize         int
-	sketchWSize       int
-	sketchSfCount     int
-	sketchFCount      int
-	pol               rabinkarp64.Pol
-	differ            delta.Differ
-	patcher           delta.Patcher
-	fingerprints      FingerprintMap
-	sketches          SketchMap
-	recipe            []Chunk
-	recipeRaw         []byte
-	files             []File
-	filesRaw          []byte
-	chunkCache        cache.Cacher
-	chunkReadWrapper  utils.ReadWrapper
-	chunkWriteWrapper utils.WriteWrapper
+	path               string
+	versions           []string
+	chunkSize          int
+	sketchWSize        int
+	sketchSfCount      int
+	sketchFCount       int
+	sketcherName       string
+	sketcher           sketch.Sketcher
+	chunkerName        string
+	cdc                *chunker.FastCDC
+	matcher            Matcher
+	spoolDir           string
+	skipUnchanged      bool
+	jobs               int
+	pol                rabinkarp64.Pol
+	differ             delta.Differ
+	patcher            delta.Patcher
+	fingerprints       FingerprintMap
+	sketches           SketchMap
+	strongHashes       StrongHashMap
+	recipe             []Chunk
+	recipeRaw          []byte
+	recipeChain        deltaChain
+	files              []File
+	filesChain         deltaChain
+	checkpointInterval int
+	checkpointRatio    float64
+	chunkCache         cache.Cacher
+	compression        string
+	compressionLevel   int
+	dictionarySize     int
+	dictionaries       [][]byte
+	exportGroupSize    int
+	deltaGain          float64
+	deltaCandidates    int
+	maxDeltaDepth      int
+	legacyVersions     int  // number of versions created before the config existed
+	configMissing      bool // the config must be stored by the next commit
+	storedDeltas       map[ChunkId]storedDelta
+	inlineChunks       map[string]Chunk
+	inlineHashes       map[Chunk][]byte
+	pendingChunks      map[ChunkId][]byte // content of the new chunks not yet written by the storage worker
+	mapsLock           sync.RWMutex       // guards the maps read by the encoding workers
+	unpacked           map[*PackedChunk][]byte
+	deltaBuffers       [2][]byte
+	deltaStats         deltaStats
+	chunkReadWrapper   utils.ReadWrapper
+	chunkWriteWrapper  utils.WriteWrapper
+	secret             []byte
+	key                []byte
+	hashKey            []byte
 }
 
+// chunkHashes are the hashes of a stored chunk. If the chunk is stored as a
+// delta, they also hold its source, the codec of its patch and its depth.
 type chunkHashes struct {
-	Fp uint64
-	Sk []uint64
+	Fp     uint64
+	Sk     []uint64
+	Strong []byte
+	Source *ChunkId
+	Codec  delta.CodecId
+	Depth  int
+}
+
+// storedDelta describes a chunk whose file holds a patch against its Source
+// instead of its content. Depth is the number of patches that need to be
+// applied to get its content.
+type storedDelta struct {
+	Source *ChunkId
+	Codec  delta.CodecId
+	Depth  int
+}
+
+// inlineChunk references a chunk of the recipe of a version that is not stored
+// in its own chunk file, either a delta or a partial chunk, along with the
+// strong hash of its content.
+type inlineChunk struct {
+	Hash  []byte
+	Index int // position of the chunk in the recipe of its version
+}
+
+// pack is a pack being filled with the partial chunks of a recipe. The ids of
+// its chunks are set once it is stored.
+type pack struct {
+	content []byte
+	chunks  []*PackedChunk
+}
+
+// deltaStats counts the delta encodings tried during all the passes of a commit
+// and the ones that have been skipped because their patch did not save enough
+// space.
+type deltaStats struct {
+	Tried   int
+	Skipped int
 }
 
 type chunkData struct {
@@ -118,9 +199,12 @@ type chunkData struct {
 }
 
 type File struct {
-	Path string
-	Size int64
-	Link string
+	Path    string
+	Size    int64
+	Link    string
+	Hash    []byte // strong hash of the content, if it is known
+	ModTime int64  // modification time, in nanoseconds since the epoch
+	Inode   uint64 // inode number, if it is available
 }
 
 func NewRepo(path string, chunkSize int) *Repo {
@@ -138,21 +222,38 @@ func NewRepo(path string, chunkSize int) *Repo {
 	if err != nil {
 		logger.Panic(err)
 	}
-	return &Repo{
-		path:              path,
-		chunkSize:         chunkSize,
-		sketchWSize:       32,
-		sketchSfCount:     3,
-		sketchFCount:      4,
-		pol:               p,
-		differ:            delta.Fdelta{},
-		patcher:           delta.Fdelta{},
-		fingerprints:      make(FingerprintMap),
-		sketches:          make(SketchMap),
-		chunkCache:        cache.NewFifoCache(10000),
-		chunkReadWrapper:  utils.ZlibReader,
-		chunkWriteWrapper: utils.ZlibWriter,
+	r := &Repo{
+		path:               path,
+		chunkSize:          chunkSize,
+		sketchWSize:        32,
+		sketchSfCount:      3,
+		sketchFCount:       4,
+		sketcherName:       sketch.RegionName,
+		chunkerName:        chunker.FixedName,
+		pol:                p,
+		differ:             delta.Fdelta{},
+		patcher:            delta.Fdelta{},
+		fingerprints:       make(FingerprintMap),
+		sketches:           make(SketchMap),
+		strongHashes:       make(StrongHashMap),
+		checkpointInterval: 64,
+		checkpointRatio:    1,
+		deltaCandidates:    1,
+		maxDeltaDepth:      1,
+		jobs:               1,
+		storedDeltas:       make(map[ChunkId]storedDelta),
+		inlineChunks:       make(map[string]Chunk),
+		inlineHashes:       make(map[Chunk][]byte),
+		pendingChunks:      make(map[ChunkId][]byte),
+		unpacked:           make(map[*PackedChunk][]byte),
+		chunkCache:         cache.NewFifoCache(10000),
+		compression:        utils.CompressionZlib,
+		chunkWriteWrapper:  utils.TagWriter(utils.CompressionZlibId, utils.ZlibWriter),
 	}
+	// the data of legacy versions is compressed with zlib without tag, the first
+	// byte of its header never matching a compression ID
+	r.chunkReadWrapper = utils.TagReader(r.decompressor, utils.ZlibReader)
+	return r
 }
 
 func (r *Repo) Differ() delta.Differ {
@@ -163,34 +264,60 @@ func (r *Repo) Patcher() delta.Patcher {
 	return r.patcher
 }
 
+// codecPatcher returns the patcher of the delta codec with the given ID, or the
+// one of the repo for patches produced by an unknown codec.
+func (r *Repo) codecPatcher(id delta.CodecId) (delta.Patcher, error) {
+	if id == delta.UnknownCodec {
+		return r.patcher, nil
+	}
+	return delta.Lookup(id)
+}
+
 func (r *Repo) Commit(source string) {
 	source, err := filepath.Abs(source)
 	if err != nil {
 		logger.Fatal(err)
 	}
+	start := time.Now()
 	r.Init()
+	r.storeMissingConfig()
 	newVersion := len(r.versions) // TODO: add newVersion functino
 	newPath := filepath.Join(r.path, fmt.Sprintf(versionFmt, newVersion))
 	newChunkPath := filepath.Join(newPath, chunksName)
 	os.Mkdir(newPath, 0775)      // TODO: handle errors
 	os.Mkdir(newChunkPath, 0775) // TODO: handle errors
+	r.trainDictionary(newVersion)
 	files := listFiles(source)
+	spliced := make(map[string]splicedFile)
+	if r.skipUnchanged {
+		r.findUnchangedFiles(files, source, spliced)
+	}
+	r.findDuplicateFiles(files, source, spliced)
 	storeQueue := make(chan chunkData, 32)
 	storeEnd := make(chan bool)
 	go r.storageWorker(newVersion, storeQueue, storeEnd)
-	var last, nlast, pass uint64
-	var recipe []Chunk
-	for ; nlast > last || pass == 0; pass++ {
-		logger.Infof("matcher pass number %d", pass+1)
-		last = nlast
-		reader, writer := io.Pipe()
-		go concatFiles(&files, writer)
-		recipe, nlast = r.matchStream(reader, storeQueue, newVersion, last)
-	}
+	r.deltaStats = deltaStats{}
+	store := &commitStore{repo: r, version: newVersion, queue: storeQueue}
+	reader, writer := io.Pipe()
+	concatEnd := make(chan bool)
+	go func() {
+		concatHashedFiles(&files, writer, r.newStrongHasher, func(f File) bool {
+			_, skip := spliced[f.Path]
+			return skip
+		})
+		concatEnd <- true
+	}()
+	recipe := r.matchSource(reader, store)
+	<-concatEnd
+	recipe, files = r.spliceFiles(files, recipe, spliced)
+	logger.Infof("delta encoding: %d/%d patches skipped for a gain below %g%%",
+		r.deltaStats.Skipped, r.deltaStats.Tried, r.deltaGain)
 	close(storeQueue)
 	<-storeEnd
+	smudgeRacyFiles(files, start)
 	r.storeFileList(newVersion, unprefixFiles(files, source))
 	r.storeRecipe(newVersion, recipe)
+	r.storeInlineChunks(newVersion, recipe)
 }
 
 func (r *Repo) Restore(destination string) {
@@ -228,6 +355,9 @@ func (r *Repo) Restore(destination string) {
 func (r *Repo) Init() {
 	var wg sync.WaitGroup
 	r.loadVersions()
+	r.loadConfig()
+	r.loadKey()
+	r.loadDictionaries()
 	wg.Add(3)
 	go r.loadHashes(r.versions, &wg)
 	go r.loadFileLists(r.versions, &wg)
@@ -259,7 +389,7 @@ func listFiles(path string) []File {
 		if i.IsDir() {
 			return nil
 		}
-		var file = File{Path: p, Size: i.Size()}
+		var file = File{Path: p, Size: i.Size(), ModTime: i.ModTime().UnixNano(), Inode: fileInode(i)}
 		if i.Mode()&fs.ModeSymlink != 0 {
 			file, err = cleanSymlink(path, p, i)
 			if err != nil {
@@ -328,9 +458,16 @@ func unprefixFiles(files []File, prefix string) (ret []File) {
 //
 // If read is incomplete, then the actual read size is used.
 func concatFiles(files *[]File, stream io.WriteCloser) {
+	concatHashedFiles(files, stream, nil, nil)
+}
+
+// concatHashedFiles is like concatFiles, but it also sets the hash of the files
+// it reads if newHash is not nil. The files for which skip returns true are kept
+// in the list without being read.
+func concatHashedFiles(files *[]File, stream io.WriteCloser, newHash func() hash.Hash, skip func(f File) bool) {
 	actual := make([]File, 0, len(*files))
 	for _, f := range *files {
-		if f.Link != "" {
+		if f.Link != "" || (skip != nil && skip(f)) {
 			actual = append(actual, f)
 			continue
 		}
@@ -340,10 +477,19 @@ func concatFiles(files *[]File, stream io.WriteCloser) {
 			continue
 		}
 		af := f
-		if n, err := io.Copy(stream, file); err != nil {
+		var out io.Writer = stream
+		var hasher hash.Hash
+		if newHash != nil {
+			hasher = newHash()
+			out = io.MultiWriter(stream, hasher)
+		}
+		if n, err := io.Copy(out, file); err != nil {
 			logger.Error("read ", n, " bytes, ", err)
 			af.Size = n
 		}
+		if hasher != nil {
+			af.Hash = hasher.Sum(nil)
+		}
 		actual = append(actual, af)
 		if err = file.Close(); err != nil {
 			logger.Panic(err)
@@ -353,29 +499,103 @@ func concatFiles(files *[]File, stream io.WriteCloser) {
 	*files = actual
 }
 
-func storeDelta(prevRaw []byte, curr interface{}, dest string, differ delta.Differ, wrapper utils.WriteWrapper) {
-	var prevBuff, currBuff bytes.Buffer
+// deltaChain keeps track of the metadata deltas stored since the last full
+// snapshot, so that we know when a new checkpoint should be made.
+type deltaChain struct {
+	Length int
+	Size   int64
+}
+
+// metadataName returns the name of the given metadata file in a version dir and
+// whether it is a full snapshot instead of a delta against the previous one.
+func metadataName(version string, name string) (string, bool) {
+	snapshot := name + snapshotExt
+	if _, err := os.Stat(filepath.Join(version, snapshot)); err == nil {
+		return snapshot, true
+	}
+	return name, false
+}
+
+// needCheckpoint tells if the next metadata of a chain should be stored as a
+// full snapshot, given the size of its delta and of its snapshot.
+func (r *Repo) needCheckpoint(chain deltaChain, deltaSize int, snapshotSize int) bool {
+	if r.checkpointInterval > 0 && chain.Length >= r.checkpointInterval {
+		return true
+	}
+	if r.checkpointRatio > 0 && chain.Length > 0 {
+		return float64(chain.Size+int64(deltaSize)) > r.checkpointRatio*float64(snapshotSize)
+	}
+	return false
+}
+
+// SetCheckpointInterval sets the maximum number of deltas of a metadata stored
+// one after the other, a full snapshot being stored once it is reached, so that
+// loading a version never needs to apply more of them. The default is 64. 0
+// disables this limit.
+func (r *Repo) SetCheckpointInterval(interval int) {
+	r.checkpointInterval = interval
+}
+
+// SetCheckpointRatio sets the maximum size of the deltas of a metadata stored
+// since its last snapshot, relative to the size of a new snapshot, beyond which
+// this new snapshot is stored instead of a delta. The default of 1 ensures that
+// a version never needs more data to load its metadata than twice a snapshot. 0
+// disables this limit.
+func (r *Repo) SetCheckpointRatio(ratio float64) {
+	r.checkpointRatio = ratio
+}
+
+// storeDelta stores curr in the given version dir as a delta against prevRaw,
+// or as a full snapshot if the delta chain has grown too long or too heavy.
+func (r *Repo) storeDelta(prevRaw []byte, curr interface{}, version int, name string, chain *deltaChain) {
+	var currBuff, deltaBuff, snapBuff bytes.Buffer
 	var encoder *gob.Encoder
 	var err error
 
-	prevBuff = *bytes.NewBuffer(prevRaw)
 	encoder = gob.NewEncoder(&currBuff)
 	if err = encoder.Encode(curr); err != nil {
 		logger.Panic(err)
 	}
 	logger.Infof("store before delta: %d", currBuff.Len())
-	file, err := os.Create(dest)
+	out := r.writeWrapper()(&deltaBuff)
+	if _, err = out.Write([]byte{byte(delta.IdOf(r.differ))}); err != nil {
+		logger.Panic(err)
+	}
+	patch, err := r.differ.Diff(nil, prevRaw, currBuff.Bytes())
 	if err != nil {
 		logger.Panic(err)
 	}
-	out := wrapper(file)
-	if err = differ.Diff(&prevBuff, &currBuff, out); err != nil {
+	if _, err = out.Write(patch); err != nil {
 		logger.Panic(err)
 	}
 	if err = out.Close(); err != nil {
 		logger.Panic(err)
 	}
-	if err = file.Close(); err != nil {
+	out = r.writeWrapper()(&snapBuff)
+	if _, err = out.Write(currBuff.Bytes()); err != nil {
+		logger.Panic(err)
+	}
+	if err = out.Close(); err != nil {
+		logger.Panic(err)
+	}
+	r.storeMetadata(version, name, chain, deltaBuff.Bytes(), snapBuff.Bytes())
+}
+
+// storeMetadata writes either the delta or the snapshot of a version's metadata
+// in its dir, depending on the state of the delta chain, which is then updated.
+func (r *Repo) storeMetadata(version int, name string, chain *deltaChain, delta []byte, snapshot []byte) {
+	dest := filepath.Join(r.path, fmt.Sprintf(versionFmt, version), name)
+	data := delta
+	if r.needCheckpoint(*chain, len(delta), len(snapshot)) {
+		logger.Infof("store %s checkpoint: %d", name, len(snapshot))
+		dest += snapshotExt
+		data = snapshot
+		*chain = deltaChain{}
+	} else {
+		chain.Length++
+		chain.Size += int64(len(delta))
+	}
+	if err := os.WriteFile(dest, data, 0664); err != nil {
 		logger.Panic(err)
 	}
 }
@@ -399,42 +619,128 @@ func readDelta(version string, name string, wrapper utils.ReadWrapper, callback
 	}
 }
 
-func loadDeltas(target interface{}, versions []string, patcher delta.Patcher, wrapper utils.ReadWrapper, name string) (ret []byte) {
-	var prev bytes.Buffer
+// lastCheckpoint returns the index of the last version that holds a full
+// snapshot of the given metadata, or -1 if there is none.
+func lastCheckpoint(versions []string, name string) int {
+	for i := len(versions) - 1; i >= 0; i-- {
+		if _, snapshot := metadataName(versions[i], name); snapshot {
+			return i
+		}
+	}
+	return -1
+}
+
+// chainSince returns the state of the delta chain of the given metadata since
+// the snapshot of version start.
+func chainSince(versions []string, name string, start int) (chain deltaChain) {
+	for _, v := range versions[start+1:] {
+		if stat, err := os.Stat(filepath.Join(v, name)); err == nil {
+			chain.Length++
+			chain.Size += stat.Size()
+		}
+	}
+	return
+}
+
+// loadDeltas rebuilds the given metadata from its last full snapshot, then
+// applies the deltas of each following version, using the patcher returned by
+// patchers for the codec ID stored at the start of each delta.
+// The deltas of the first legacy versions do not start with a codec ID, they
+// are applied with the patcher of UnknownCodec.
+// If loaded is not nil, it is called with the encoded metadata of each version
+// once it has been rebuilt.
+// It also returns the state of the delta chain since this snapshot.
+func loadDeltas(target interface{}, versions []string, legacy int, patchers func(delta.CodecId) (delta.Patcher, error), wrapper utils.ReadWrapper, name string, loaded func(version string, raw []byte)) (ret []byte, chain deltaChain) {
+	var prev []byte
 	var err error
-	for _, v := range versions {
+	start := lastCheckpoint(versions, name)
+	if start >= 0 {
+		logger.Infof("load %s checkpoint from version %d", name, start)
+		readDelta(versions[start], name+snapshotExt, wrapper, func(in io.ReadCloser) {
+			if prev, err = io.ReadAll(in); err != nil {
+				logger.Panic(err)
+			}
+		})
+		if loaded != nil {
+			loaded(versions[start], prev)
+		}
+	}
+	for i := start + 1; i < len(versions); i++ {
+		v := versions[i]
 		readDelta(v, name, wrapper, func(in io.ReadCloser) {
-			var curr bytes.Buffer
-			if err = patcher.Patch(&prev, &curr, in); err != nil {
+			patch, err := io.ReadAll(in)
+			if err != nil {
+				logger.Panic(err)
+			}
+			codec := delta.UnknownCodec
+			if i >= legacy {
+				if len(patch) == 0 {
+					logger.Panicf("empty %s delta in %s", name, v)
+				}
+				codec, patch = delta.CodecId(patch[0]), patch[1:]
+			}
+			patcher, err := patchers(codec)
+			if err != nil {
+				logger.Panic(err)
+			}
+			if prev, err = patcher.Patch(nil, prev, patch); err != nil {
 				logger.Panic(err)
 			}
-			prev = curr
 		})
+		if loaded != nil {
+			loaded(v, prev)
+		}
 	}
-	ret = prev.Bytes()
+	chain = chainSince(versions, name, start)
+	ret = prev
 	if len(ret) == 0 {
 		return
 	}
-	decoder := gob.NewDecoder(&prev)
+	decoder := gob.NewDecoder(bytes.NewReader(prev))
 	if err = decoder.Decode(target); err != nil {
 		logger.Panic(err)
 	}
 	return
 }
 
-// storeFileList stores the given list in the repo dir as a delta against the
-// previous version's one.
+// storeFileList stores the given list in the repo dir as a structural delta
+// against the previous version's one.
 func (r *Repo) storeFileList(version int, list []File) {
 	logger.Info("store files")
-	dest := filepath.Join(r.path, fmt.Sprintf(versionFmt, version), filesName)
-	storeDelta(r.filesRaw, list, dest, r.differ, r.chunkWriteWrapper)
+	delta := r.encodeFileOps(diffFileLists(r.files, list))
+	snapshot := r.encodeFileOps(diffFileLists(nil, list))
+	r.storeMetadata(version, filesName, &r.filesChain, delta, snapshot)
 }
 
-// loadFileLists loads incrementally the file lists' delta of each given version.
+// loadFileLists rebuilds the file list from the last snapshot, then applies
+// the structural deltas of each following version.
+//
+// Legacy versions store their file list as a delta of its gob encoding against
+// the previous one instead. Without snapshot, their file lists are rebuilt
+// first.
 func (r *Repo) loadFileLists(versions []string, wg *sync.WaitGroup) {
 	logger.Info("load previous file lists")
 	var files []File
-	r.filesRaw = loadDeltas(&files, versions, r.patcher, r.chunkReadWrapper, filesName)
+	var err error
+	apply := func(version string, name string) {
+		ops := loadFileOps(version, name, r.readWrapper())
+		if files, err = patchFileList(files, ops); err != nil {
+			logger.Panicf("%s: %s", filepath.Join(version, name), err)
+		}
+	}
+	start := lastCheckpoint(versions, filesName)
+	if start >= 0 {
+		logger.Infof("load %s checkpoint from version %d", filesName, start)
+		apply(versions[start], filesName+snapshotExt)
+	} else if r.legacyVersions > 0 {
+		start = r.legacyVersions - 1
+		logger.Infof("load legacy %s up to version %d", filesName, start)
+		loadDeltas(&files, versions[:start+1], r.legacyVersions, r.codecPatcher, r.readWrapper(), filesName, nil)
+	}
+	for _, v := range versions[start+1:] {
+		apply(v, filesName)
+	}
+	r.filesChain = chainSince(versions, filesName, start)
 	r.files = files
 	wg.Done()
 }
@@ -442,6 +748,10 @@ func (r *Repo) loadFileLists(versions []string, wg *sync.WaitGroup) {
 // storageWorker is meant to be started in a goroutine and stores each new chunk's
 // data in the repo directory until the store queue channel is closed.
 //
+// The hashes are written in the order of the queue, as their position gives the
+// index of the chunk, while the chunk files are compressed and written by up to
+// jobs goroutines.
+//
 // it will put true in the end channel once everything is stored.
 func (r *Repo) storageWorker(version int, storeQueue <-chan chunkData, end chan<- bool) {
 	hashesFile := filepath.Join(r.path, fmt.Sprintf(versionFmt, version), hashesName)
@@ -449,11 +759,29 @@ func (r *Repo) storageWorker(version int, storeQueue <-chan chunkData, end chan<
 	if err != nil {
 		logger.Panic(err)
 	}
-	encoder := gob.NewEncoder(file)
+	wrapper := r.writeWrapper()(file)
+	encoder := gob.NewEncoder(wrapper)
+	workers := make(chan bool, r.jobs)
+	var wg sync.WaitGroup
 	for data := range storeQueue {
-		err = encoder.Encode(data.hashes)
-		r.StoreChunkContent(data.id, bytes.NewReader(data.content))
-		// logger.Debug("stored ", data.id)
+		if err = encoder.Encode(data.hashes); err != nil {
+			logger.Error("chunk hashes ", err)
+		}
+		workers <- true
+		wg.Add(1)
+		go func(data chunkData) {
+			r.StoreChunkContent(data.id, bytes.NewReader(data.content))
+			r.mapsLock.Lock()
+			delete(r.pendingChunks, *data.id)
+			r.mapsLock.Unlock()
+			// logger.Debug("stored ", data.id)
+			<-workers
+			wg.Done()
+		}(data)
+	}
+	wg.Wait()
+	if err = wrapper.Close(); err != nil {
+		logger.Panic("chunk hashes ", err)
 	}
 	if err = file.Close(); err != nil {
 		logger.Panic(err)
@@ -467,7 +795,7 @@ func (r *Repo) StoreChunkContent(id *ChunkId, reader io.Reader) {
 	if err != nil {
 		logger.Panic("chunk store ", err)
 	}
-	wrapper := r.chunkWriteWrapper(file)
+	wrapper := r.writeWrapper()(file)
 	n, err := io.Copy(wrapper, reader)
 	if err != nil {
 		logger.Errorf("chunk store, %d written, %s", n, err)
@@ -483,14 +811,26 @@ func (r *Repo) StoreChunkContent(id *ChunkId, reader io.Reader) {
 // LoadChunkContent loads a chunk from the repo directory.
 // If the chunk is in cache, get it from cache, else read it from drive.
 func (r *Repo) LoadChunkContent(id *ChunkId) *bytes.Reader {
+	return bytes.NewReader(r.loadChunkBytes(id))
+}
+
+// loadChunkBytes is like LoadChunkContent, but returns the content of the chunk
+// itself, which is shared with the cache and thus must not be modified.
+func (r *Repo) loadChunkBytes(id *ChunkId) []byte {
 	value, exists := r.chunkCache.Get(id)
+	if !exists {
+		// a new chunk can be found by the encoding workers before it is written
+		r.mapsLock.RLock()
+		value, exists = r.pendingChunks[*id]
+		r.mapsLock.RUnlock()
+	}
 	if !exists {
 		path := id.Path(r.path)
 		f, err := os.Open(path)
 		if err != nil {
 			logger.Panic("chunk load ", err)
 		}
-		wrapper, err := r.chunkReadWrapper(f)
+		wrapper, err := r.readWrapper()(f)
 		if err != nil {
 			logger.Error("chunk load wrapper ", err)
 		}
@@ -504,9 +844,61 @@ func (r *Repo) LoadChunkContent(id *ChunkId) *bytes.Reader {
 		if err = f.Close(); err != nil {
 			logger.Warning("chunk load ", err)
 		}
+		r.mapsLock.RLock()
+		d, isDelta := r.storedDeltas[*id]
+		r.mapsLock.RUnlock()
+		if isDelta {
+			value = r.applyStoredDelta(d, value)
+		}
 		r.chunkCache.Set(id, value)
 	}
-	return bytes.NewReader(value)
+	return value
+}
+
+// applyStoredDelta rebuilds the content of a chunk stored as a delta.
+func (r *Repo) applyStoredDelta(d storedDelta, patch []byte) []byte {
+	patcher, err := r.codecPatcher(d.Codec)
+	if err != nil {
+		logger.Panic("stored delta ", err)
+	}
+	content, err := delta.PatchLimit(patcher, make([]byte, 0, r.chunkSize), r.loadChunkBytes(d.Source), patch, r.maxChunkSize())
+	if err != nil {
+		logger.Error("stored delta ", err)
+	}
+	return content
+}
+
+// SetJobs sets the number of goroutines used to sketch, delta-encode, compress
+// and write the new chunks during a commit, and to decode the chunks during a
+// restore. The default is 1. Whatever their number, the chunks are matched in
+// the order of the source, so a commit gives the same version.
+func (r *Repo) SetJobs(jobs int) {
+	if jobs < 1 {
+		jobs = 1
+	}
+	r.jobs = jobs
+}
+
+// chunkDepth returns the number of patches needed to get the content of the
+// chunk with the given id.
+// chunkDepth must be called while holding mapsLock, unless it is called by
+// the goroutine that stores the chunks.
+func (r *Repo) chunkDepth(id *ChunkId) int {
+	return r.storedDeltas[*id].Depth
+}
+
+// SetMaxDeltaDepth sets the maximum number of patches that can be needed to get
+// the content of a chunk, which bounds the cost of restoring it.
+//
+// With the default of 1, chunks are only delta-encoded against stored chunks.
+// With more, delta-encoded chunks are stored as chunk files holding their patch
+// as long as their depth is lower than the maximum, so that they can in turn be
+// used as sources of new deltas.
+func (r *Repo) SetMaxDeltaDepth(depth int) {
+	if depth < 1 {
+		depth = 1
+	}
+	r.maxDeltaDepth = depth
 }
 
 // TODO: use atoi for chunkid ?
@@ -533,6 +925,9 @@ func (r *Repo) loadChunks(versions []string) (chunks [][]IdentifiedChunk) {
 
 // loadHashes loads and aggregates the hashes stored for each given version and
 // stores them in the repo maps.
+//
+// The hashes of the legacy versions of a repo were not wrapped, they are thus
+// read as is.
 func (r *Repo) loadHashes(versions []string, wg *sync.WaitGroup) {
 	logger.Info("load previous hashes")
 	for i, v := range versions {
@@ -541,13 +936,25 @@ func (r *Repo) loadHashes(versions []string, wg *sync.WaitGroup) {
 		if err != nil {
 			logger.Error("hashes ", err)
 		}
-		decoder := gob.NewDecoder(file)
+		var reader io.Reader = file
+		if i >= r.legacyVersions {
+			if reader, err = r.readWrapper()(file); err != nil {
+				logger.Panic("hashes ", err)
+			}
+		}
+		decoder := gob.NewDecoder(reader)
 		for j := 0; err == nil; j++ {
 			var h chunkHashes
 			if err = decoder.Decode(&h); err == nil {
 				id := &ChunkId{i, uint64(j)}
 				r.fingerprints[h.Fp] = id
 				r.sketches.Set(h.Sk, id)
+				if len(h.Strong) > 0 {
+					r.strongHashes[*id] = h.Strong
+				}
+				if h.Source != nil {
+					r.storedDeltas[*id] = storedDelta{h.Source, h.Codec, h.Depth}
+				}
 			}
 		}
 		if err != nil && err != io.EOF {
@@ -560,6 +967,149 @@ func (r *Repo) loadHashes(versions []string, wg *sync.WaitGroup) {
 	wg.Done()
 }
 
+// storeInlineChunks stores a reference to each inline chunk of the given recipe,
+// along with the strong hash of its content, so that the same content is
+// encoded the same way by the next commits. All of them are referenced, and not
+// only the new ones, so that the ones that are still used are kept when the
+// recipe is stored as a snapshot.
+func (r *Repo) storeInlineChunks(version int, recipe []Chunk) {
+	path := filepath.Join(r.path, fmt.Sprintf(versionFmt, version), inlineName)
+	file, err := os.Create(path)
+	if err != nil {
+		logger.Panic(err)
+	}
+	wrapper := r.writeWrapper()(file)
+	encoder := gob.NewEncoder(wrapper)
+	stored := make(map[Chunk]bool)
+	for i, c := range recipe {
+		if hash, isInline := r.inlineHashes[c]; isInline && !stored[c] {
+			if err = encoder.Encode(inlineChunk{hash, i}); err != nil {
+				logger.Panic("inline chunks ", err)
+			}
+			stored[c] = true
+		}
+	}
+	if err = wrapper.Close(); err != nil {
+		logger.Panic("inline chunks ", err)
+	}
+	if err = file.Close(); err != nil {
+		logger.Panic(err)
+	}
+}
+
+// loadInlineChunks loads the inline chunks referenced by the given version into
+// the repo maps, taking them from its recipe, which is only built if needed.
+// Versions created before they were stored are skipped.
+//
+// It is called for each version whose recipe is rebuilt, so the inline chunks
+// that are not used by any version since the last snapshot of the recipe are
+// forgotten. Their content is then only encoded again.
+func (r *Repo) loadInlineChunks(version string, buildRecipe func() []Chunk) {
+	file, err := os.Open(filepath.Join(version, inlineName))
+	if errors.Is(err, fs.ErrNotExist) {
+		return
+	} else if err != nil {
+		logger.Panic("inline chunks ", err)
+	}
+	reader, err := r.readWrapper()(file)
+	if err != nil {
+		logger.Panic("inline chunks ", err)
+	}
+	decoder := gob.NewDecoder(reader)
+	var recipe []Chunk
+	for err == nil {
+		var c inlineChunk
+		if err = decoder.Decode(&c); err != nil {
+			break
+		}
+		if recipe == nil {
+			recipe = buildRecipe()
+		}
+		if c.Index < 0 || c.Index >= len(recipe) {
+			logger.Panicf("inline chunk %d out of recipe of size %d in %s", c.Index, len(recipe), version)
+		}
+		chunk := recipe[c.Index]
+		if rc, isRepo := chunk.(RepoChunk); isRepo {
+			rc.SetRepo(r)
+		}
+		r.inlineChunks[string(c.Hash)] = chunk
+		r.inlineHashes[chunk] = c.Hash
+	}
+	if err != io.EOF {
+		logger.Panic("inline chunks ", err)
+	}
+	if err = file.Close(); err != nil {
+		logger.Warning(err)
+	}
+}
+
+// findInlineChunk returns the inline chunk already encoded for the content of
+// the given strong hash, if any. A delta chunk made by another differ than the
+// current one is not reused, so that changing the differ of a repo applies to
+// all the new delta chunks of its next versions.
+// findInlineChunk must be called while holding mapsLock, unless it is called by
+// the goroutine that stores the chunks.
+func (r *Repo) findInlineChunk(strong []byte) (Chunk, bool) {
+	c, exists := r.inlineChunks[string(strong)]
+	if d, isDelta := c.(*DeltaChunk); isDelta && d.Codec != delta.IdOf(r.differ) {
+		return nil, false
+	}
+	return c, exists
+}
+
+// addInlineChunk registers a chunk that will be stored inline in the recipe,
+// so that a chunk with the same content found later is encoded the same way.
+func (r *Repo) addInlineChunk(hash []byte, c Chunk) {
+	r.mapsLock.Lock()
+	r.inlineChunks[string(hash)] = c
+	r.mapsLock.Unlock()
+	r.inlineHashes[c] = hash
+}
+
+// strongHash returns the SHA-256 hash of the given data. For encrypted repos it
+// is keyed using HMAC, so that it does not leak anything about the content.
+func (r *Repo) strongHash(data []byte) []byte {
+	if r.hashKey != nil {
+		mac := hmac.New(sha256.New, r.hashKey)
+		mac.Write(data)
+		return mac.Sum(nil)
+	}
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+// newStrongHasher returns a hash computing the same strong hash as strongHash,
+// for contents that are streamed.
+func (r *Repo) newStrongHasher() hash.Hash {
+	if r.hashKey != nil {
+		return hmac.New(sha256.New, r.hashKey)
+	}
+	return sha256.New()
+}
+
+// confirmMatch checks that the given data really is the content of the chunk
+// whose fingerprint it matches, as the rolling hash is only used as a candidate
+// filter and could collide.
+//
+// The strong hash of the chunk is used if it is known, otherwise (for chunks
+// stored before strong hashes were introduced) its content is compared.
+func (r *Repo) confirmMatch(id *ChunkId, data []byte) bool {
+	var same bool
+	if strong, exists := r.strongHashes[*id]; exists {
+		same = bytes.Equal(strong, r.strongHash(data))
+	} else {
+		content, err := io.ReadAll(r.LoadChunkContent(id))
+		if err != nil {
+			logger.Error("confirm match ", err)
+		}
+		same = bytes.Equal(content, data)
+	}
+	if !same {
+		logger.Warningf("fingerprint collision with chunk %v", *id)
+	}
+	return same
+}
+
 func (r *Repo) chunkMinLen() int {
 	return sketch.SuperFeatureSize(r.chunkSize, r.sketchSfCount, r.sketchFCount)
 }
@@ -573,184 +1123,410 @@ func contains(s []*ChunkId, id *ChunkId) bool {
 	return false
 }
 
-// findSimilarChunk looks in the repo sketch map for a match of the given sketch.
+// SetChunker selects the algorithm used to split the data into chunks: either
+// fixed size chunks matched using a rolling hash, or content-defined chunks of
+// variable size. It is only taken into account for new repos, as the chunks of
+// existing ones can only be matched by the chunker that produced them, so their
+// chunker is stored in their config.
+func (r *Repo) SetChunker(name string) error {
+	if err := chunker.Check(name); err != nil {
+		return err
+	}
+	r.chunkerName = name
+	r.cdc = nil
+	return nil
+}
+
+// contentChunker returns the content-defined chunker of the repo, which is
+// created on first use as its Gear table depends on its polynomial. Its chunks
+// are between a quarter and four times the chunk size, the chunk size on
+// average.
+func (r *Repo) contentChunker() *chunker.FastCDC {
+	if r.cdc == nil {
+		r.cdc = chunker.NewFastCDC(int64(r.pol), r.chunkSize/4, r.chunkSize, r.maxChunkSize())
+	}
+	return r.cdc
+}
+
+// maxChunkSize returns the size of the largest chunks produced by the chunker of
+// the repo.
+func (r *Repo) maxChunkSize() int {
+	if r.chunkerName == chunker.FastCDCName {
+		return r.chunkSize * 4
+	}
+	return r.chunkSize
+}
+
+// isFullChunk returns true if a chunk of the given size is not partial, and
+// can thus be stored on its own. With content-defined chunking, only the last
+// chunk of a stream can be smaller than the minimum size.
+func (r *Repo) isFullChunk(size int) bool {
+	if r.chunkerName == chunker.FastCDCName {
+		return size >= r.contentChunker().Min
+	}
+	return size == r.chunkSize
+}
+
+// newStoredChunk returns a reference to the stored chunk of the given id, that
+// records its size if it differs from the chunk size of the repo.
+func (r *Repo) newStoredChunk(id *ChunkId, size int) *StoredChunk {
+	c := NewStoredChunk(r, id)
+	if size != r.chunkSize {
+		c.Size = size
+	}
+	return c
+}
+
+// SetSketcher selects the algorithm used to compute the sketches of the chunks.
+// It is only taken into account for new repos, as the sketches of existing ones
+// must stay comparable, so their sketcher is stored in their config.
+func (r *Repo) SetSketcher(name string) error {
+	if _, err := sketch.New(name, r.sketchParams()); err != nil {
+		return err
+	}
+	r.sketcherName = name
+	r.sketcher = nil
+	return nil
+}
+
+func (r *Repo) sketchParams() sketch.Params {
+	return sketch.Params{
+		Pol:       r.pol,
+		ChunkSize: r.chunkSize,
+		WSize:     r.sketchWSize,
+		SfCount:   r.sketchSfCount,
+		FCount:    r.sketchFCount,
+	}
+}
+
+// sketchChunk computes the sketch of the given chunk using the sketcher of the
+// repo, which is created on first use as it depends on its polynomial.
+func (r *Repo) sketchChunk(chunk []byte) sketch.Sketch {
+	return r.chunkSketcher().Sketch(chunk)
+}
+
+// chunkSketcher returns the sketcher of the repo, creating it the first time.
+// As the encoding workers share it, it must first be called before starting
+// them.
+func (r *Repo) chunkSketcher() sketch.Sketcher {
+	if r.sketcher == nil {
+		var err error
+		if r.sketcher, err = sketch.New(r.sketcherName, r.sketchParams()); err != nil {
+			logger.Panic(err)
+		}
+	}
+	return r.sketcher
+}
+
+// findSimilarChunks looks in the repo sketch map for matches of the given
+// sketch and returns at most count of them, the best ones first. Chunks that
+// are already at the maximum delta depth are ignored.
 //
-// There can be multiple matches but only the best one is returned. Indeed, the
-// more superfeature matches, the better the quality of the match. For now we
-// consider that a single superfeature match is enough to count it as valid.
-func (r *Repo) findSimilarChunk(sketch []uint64) (*ChunkId, bool) {
+// Indeed, the more superfeature matches, the better the quality of the match.
+// Ties are broken by keeping the first seen chunks first. For now we consider
+// that a single superfeature match is enough to count it as valid.
+func (r *Repo) findSimilarChunks(sketch []uint64, count int) []*ChunkId {
+	r.mapsLock.RLock()
+	defer r.mapsLock.RUnlock()
 	var similarChunks = make(map[ChunkId]int)
-	var max int
-	var similarChunk *ChunkId
+	var order []*ChunkId
 	for _, s := range sketch {
 		chunkIds, exists := r.sketches[s]
 		if !exists {
 			continue
 		}
 		for _, id := range chunkIds {
-			count := similarChunks[*id]
-			count += 1
-			logger.Debugf("found %d %d time(s)", id, count)
-			if count > max {
-				max = count
-				similarChunk = id
+			if r.chunkDepth(id) >= r.maxDeltaDepth {
+				// a delta against it would be too deep
+				continue
+			}
+			c := similarChunks[*id]
+			if c == 0 {
+				order = append(order, id)
 			}
-			similarChunks[*id] = count
+			c += 1
+			logger.Debugf("found %d %d time(s)", id, c)
+			similarChunks[*id] = c
 		}
 	}
-	return similarChunk, max > 0
+	sort.SliceStable(order, func(i, j int) bool {
+		return similarChunks[*order[i]] > similarChunks[*order[j]]
+	})
+	if len(order) > count {
+		order = order[:count]
+	}
+	return order
+}
+
+// SetDeltaCandidates sets the number of similar chunks against which a chunk is
+// delta-encoded, the smallest patch being kept. The default is 1: only the
+// best match according to the sketches is tried.
+func (r *Repo) SetDeltaCandidates(count int) {
+	if count < 1 {
+		count = 1
+	}
+	r.deltaCandidates = count
+}
+
+// bestDelta delta-encodes the given chunk against each of the candidates and
+// returns the smallest patch.
+//
+// Patches are produced in the given scratch buffers, so that only the one that
+// is kept needs a new allocation.
+func (r *Repo) bestDelta(temp BufferedChunk, candidates []*ChunkId, buffers *[2][]byte) (best *ChunkId, patch []byte) {
+	trial, kept := buffers[0][:0], buffers[1][:0]
+	for _, id := range candidates {
+		var err error
+		trial, err = r.differ.Diff(trial[:0], r.loadChunkBytes(id), temp.Bytes())
+		if err != nil {
+			logger.Error("trying delta encode chunk:", temp, "with source:", id, ":", err)
+			continue
+		}
+		if best == nil || len(trial) < len(kept) {
+			best = id
+			trial, kept = kept, trial
+		}
+	}
+	*buffers = [2][]byte{trial, kept}
+	if best != nil {
+		patch = append([]byte(nil), kept...)
+	}
+	return
+}
+
+// SetDeltaGain sets the minimum gain, in percent, that a patch must bring
+// compared to the chunk it encodes for a delta chunk to be used. With 0, which
+// is the default, the patch only needs to be smaller than the chunk.
+func (r *Repo) SetDeltaGain(gain float64) {
+	r.deltaGain = gain
+}
+
+// deltaWorthIt reports whether the given patch is small enough compared to the
+// data it encodes. As both would be compressed, their compressed sizes are
+// compared.
+func (r *Repo) deltaWorthIt(patch []byte, data []byte) bool {
+	patchSize := float64(r.compressedSize(patch))
+	dataSize := float64(r.compressedSize(data))
+	return patchSize < dataSize && patchSize <= dataSize*(1-r.deltaGain/100)
+}
+
+func (r *Repo) compressedSize(data []byte) int {
+	counter := utils.NewWriteCounter(io.Discard)
+	out := r.chunkWriteWrapper(counter)
+	if _, err := out.Write(data); err != nil {
+		logger.Panic(err)
+	}
+	if err := out.Close(); err != nil {
+		logger.Panic(err)
+	}
+	return counter.Count()
+}
+
+// tempEncoding is what is computed about a new chunk before encoding it: its
+// hashes and its best delta against the similar chunks known at this time.
+type tempEncoding struct {
+	strong     []byte
+	sk         sketch.Sketch
+	fp         uint64
+	candidates []*ChunkId
+	source     *ChunkId
+	patch      []byte
+	worthIt    bool
+}
+
+// fingerprint returns the rolling hash of the given chunk, as computed by the
+// matchers.
+func (r *Repo) fingerprint(chunk []byte) uint64 {
+	hasher := rabinkarp64.NewFromPol(r.pol)
+	hasher.Write(chunk)
+	return hasher.Sum64()
+}
+
+// prepareTempChunk computes the encoding of the given chunk, fp being its
+// fingerprint if it is full. It does not modify
+// the repo, so it can be called by several workers at once while the chunks
+// are stored.
+//
+// If the chunk is already known as an inline chunk, its delta is not computed.
+func (r *Repo) prepareTempChunk(temp BufferedChunk, fp uint64, buffers *[2][]byte) *tempEncoding {
+	e := &tempEncoding{strong: r.strongHash(temp.Bytes()), fp: fp}
+	r.mapsLock.RLock()
+	_, isInline := r.findInlineChunk(e.strong)
+	r.mapsLock.RUnlock()
+	if !isInline {
+		e.sk = r.sketchChunk(temp.Bytes())
+		r.tryDelta(temp, e, buffers)
+	}
+	return e
+}
+
+// tryDelta sets the best delta of the given chunk against the similar chunks
+// known at this time.
+func (r *Repo) tryDelta(temp BufferedChunk, e *tempEncoding, buffers *[2][]byte) {
+	e.candidates = r.findSimilarChunks(e.sk, r.deltaCandidates)
+	e.source, e.patch = r.bestDelta(temp, e.candidates, buffers)
+	e.worthIt = e.source != nil && r.deltaWorthIt(e.patch, temp.Bytes())
+}
+
+func sameChunkIds(a []*ChunkId, b []*ChunkId) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if *a[i] != *b[i] {
+			return false
+		}
+	}
+	return true
 }
 
 // encodeTempChunk first tries to delta-encode the given chunk before attributing
 // it an Id and saving it into the fingerprints and sketches maps.
-func (r *Repo) encodeTempChunk(temp BufferedChunk, version int, last *uint64, storeQueue chan<- chunkData) (Chunk, bool) {
-	sk, _ := sketch.SketchChunk(temp.Reader(), r.pol, r.chunkSize, r.sketchWSize, r.sketchSfCount, r.sketchFCount)
-	id, found := r.findSimilarChunk(sk)
-	if found {
-		var buff bytes.Buffer
-		if err := r.differ.Diff(r.LoadChunkContent(id), temp.Reader(), &buff); err != nil {
-			logger.Error("trying delta encode chunk:", temp, "with source:", id, ":", err)
+//
+// The chunks must be encoded in the order of the stream, as the ones stored
+// before can be used as sources of the deltas. Thus, if chunks similar to this
+// one have been stored since its encoding was prepared, its delta is computed
+// again.
+func (r *Repo) encodeTempChunk(temp BufferedChunk, e *tempEncoding, version int, last *uint64, storeQueue chan<- chunkData) (Chunk, bool) {
+	if c, exists := r.findInlineChunk(e.strong); exists {
+		logger.Debug("add existing inline chunk of size: ", temp.Len())
+		_, isDelta := c.(*DeltaChunk)
+		return c, isDelta
+	}
+	if e.sk == nil {
+		e.sk = r.sketchChunk(temp.Bytes())
+		r.tryDelta(temp, e, &r.deltaBuffers)
+	} else if !sameChunkIds(e.candidates, r.findSimilarChunks(e.sk, r.deltaCandidates)) {
+		r.tryDelta(temp, e, &r.deltaBuffers)
+	}
+	hashes := chunkHashes{Fp: e.fp, Sk: e.sk, Strong: e.strong}
+	if id := e.source; id != nil {
+		r.deltaStats.Tried++
+		if !e.worthIt {
+			r.deltaStats.Skipped++
+			logger.Debugf("skip delta chunk of size %d for a chunk of size %d", len(e.patch), temp.Len())
+		} else if depth := r.chunkDepth(id) + 1; depth < r.maxDeltaDepth && r.isFullChunk(temp.Len()) {
+			c := r.storeChunk(temp, hashes, version, last, storeQueue, &storedDelta{id, delta.IdOf(r.differ), depth}, e.patch)
+			logger.Debugf("add new stored delta chunk %d of depth %d and size %d", c.GetId(), depth, len(e.patch))
+			return c, true
 		} else {
-			logger.Debugf("add new delta chunk of size %d", len(buff.Bytes()))
-			return &DeltaChunk{
+			logger.Debugf("add new delta chunk of size %d", len(e.patch))
+			c := &DeltaChunk{
 				repo:   r,
 				Source: id,
-				Patch:  buff.Bytes(),
+				Patch:  e.patch,
 				Size:   temp.Len(),
-			}, true
-		}
-	}
-	if temp.Len() == r.chunkSize {
-		id := &ChunkId{Ver: version, Idx: *last}
-		*last++
-		hasher := rabinkarp64.NewFromPol(r.pol)
-		io.Copy(hasher, temp.Reader())
-		fp := hasher.Sum64()
-		r.fingerprints[fp] = id
-		r.sketches.Set(sk, id)
-		storeQueue <- chunkData{
-			hashes:  chunkHashes{fp, sk},
-			content: temp.Bytes(),
-			id:      id,
-		}
-		r.chunkCache.Set(id, temp.Bytes())
-		logger.Debug("add new chunk ", id)
-		return NewStoredChunk(r, id), false
+				Codec:  delta.IdOf(r.differ),
+			}
+			r.addInlineChunk(e.strong, c)
+			return c, true
+		}
+	}
+	if r.isFullChunk(temp.Len()) {
+		c := r.storeChunk(temp, hashes, version, last, storeQueue, nil, temp.Bytes())
+		logger.Debug("add new chunk ", c.GetId())
+		return c, false
+	}
+	if temp.Len() < r.chunkSize {
+		c := r.packChunk(temp)
+		logger.Debug("add new packed chunk of size: ", temp.Len())
+		r.addInlineChunk(e.strong, c)
+		return c, false
 	}
 	logger.Debug("add new partial chunk of size: ", temp.Len())
 	return temp, false
 }
 
-// encodeTempChunks encodes the current temporary chunks based on the value of the previous one.
-// Temporary chunks can be partial. If the current chunk is smaller than the size of a
-// super-feature and there exists a previous chunk, then both are merged before attempting
-// to delta-encode them.
-func (r *Repo) encodeTempChunks(prev BufferedChunk, curr BufferedChunk, version int, last *uint64, storeQueue chan<- chunkData) []Chunk {
-	if reflect.ValueOf(prev).IsNil() {
-		c, _ := r.encodeTempChunk(curr, version, last, storeQueue)
-		return []Chunk{c}
-	} else if curr.Len() < r.chunkMinLen() {
-		tmp := NewTempChunk(append(prev.Bytes(), curr.Bytes()...))
-		c, success := r.encodeTempChunk(tmp, version, last, storeQueue)
-		if success {
-			return []Chunk{c}
-		}
-	}
-	prevD, _ := r.encodeTempChunk(prev, version, last, storeQueue)
-	currD, _ := r.encodeTempChunk(curr, version, last, storeQueue)
-	return []Chunk{prevD, currD}
+// packChunk returns a new packed chunk for a partial chunk. Its pack and its
+// offset in it are only set by storePacks.
+func (r *Repo) packChunk(temp BufferedChunk) *PackedChunk {
+	c := &PackedChunk{repo: r, Size: temp.Len()}
+	r.unpacked[c] = append([]byte(nil), temp.Bytes()...)
+	return c
 }
 
-// matchStream is the heart of DNA-backup. Thus, it sounded rude not to add some comment to it.
+// storePacks packs the new partial chunks of the given recipe in its order,
+// each pack being filled until the next chunk does not fit in it. The packs are
+// then stored as new chunks, and the id of the chunks packed in them is set.
 //
-// It applies a rolling hash on the content of a given stream to look for matching fingerprints
-// in the repo. If no match is found after the equivalent of three chunks of data are processed,
-// then the first unmatched chunk sketch is checked to see if it could be delta-encoded.
-// If not, the chunk is then stored as a new chunk for this version and its fingerprint and
-// sketch are added to the repo maps.
-//
-// If a match happens during the processing of the third chunk, then, if possible, the remaining
-// of the second chunk is merged with the first one to try to delta encode it at once.
-//
-// Each time a new chunk is added it is sent to the store worker through the store queue.
-func (r *Repo) matchStream(stream io.Reader, storeQueue chan<- chunkData, version int, last uint64) ([]Chunk, uint64) {
-	var b byte
-	var chunks []Chunk
-	var prev *TempChunk
-	var err error
-	bufStream := bufio.NewReaderSize(stream, r.chunkSize*2)
-	buff := make([]byte, r.chunkSize, r.chunkSize*2)
-	if n, err := io.ReadFull(stream, buff); n < r.chunkSize {
-		if err == io.ErrUnexpectedEOF {
-			c, _ := r.encodeTempChunk(NewTempChunk(buff[:n]), version, &last, storeQueue)
-			chunks = append(chunks, c)
-			return chunks, last
-		} else {
-			logger.Panicf("matching stream, read only %d bytes with error '%s'", n, err)
+// It is only called once the final recipe is known: as a matcher pass can
+// replace the partial chunks of the previous one, packing them earlier could
+// store data that is not referenced, and make the packs depend on the order in
+// which the encoding workers end. The partial chunks that did not make it into
+// the recipe are forgotten.
+func (r *Repo) storePacks(recipe []Chunk, version int, last *uint64, storeQueue chan<- chunkData) {
+	var packs []pack
+	for _, c := range recipe {
+		pc, isPacked := c.(*PackedChunk)
+		if !isPacked {
+			continue
 		}
-	}
-	hasher := rabinkarp64.NewFromPol(r.pol)
-	hasher.Write(buff)
-	for err != io.EOF {
-		h := hasher.Sum64()
-		chunkId, exists := r.fingerprints[h]
-		if exists {
-			if len(buff) > r.chunkSize && len(buff) <= r.chunkSize*2 {
-				size := len(buff) - r.chunkSize
-				temp := NewTempChunk(buff[:size])
-				chunks = append(chunks, r.encodeTempChunks(prev, temp, version, &last, storeQueue)...)
-				prev = nil
-			} else if prev != nil {
-				c, _ := r.encodeTempChunk(prev, version, &last, storeQueue)
-				chunks = append(chunks, c)
-				prev = nil
-			}
-			logger.Debugf("add existing chunk: %d", chunkId)
-			chunks = append(chunks, NewStoredChunk(r, chunkId))
-			buff = make([]byte, 0, r.chunkSize*2)
-			for i := 0; i < r.chunkSize && err == nil; i++ {
-				b, err = bufStream.ReadByte()
-				if err != io.EOF {
-					hasher.Roll(b)
-					buff = append(buff, b)
-				}
-			}
+		content, isNew := r.unpacked[pc]
+		if !isNew {
 			continue
 		}
-		if len(buff) == r.chunkSize*2 {
-			if prev != nil {
-				chunk, _ := r.encodeTempChunk(prev, version, &last, storeQueue)
-				chunks = append(chunks, chunk)
-			}
-			prev = NewTempChunk(buff[:r.chunkSize])
-			tmp := buff[r.chunkSize:]
-			buff = make([]byte, r.chunkSize, r.chunkSize*2)
-			copy(buff, tmp)
-		}
-		b, err = bufStream.ReadByte()
-		if err != io.EOF {
-			hasher.Roll(b)
-			buff = append(buff, b)
-		}
-	}
-	if len(buff) > 0 {
-		var temp *TempChunk
-		if len(buff) > r.chunkSize {
-			if prev != nil {
-				chunk, _ := r.encodeTempChunk(prev, version, &last, storeQueue)
-				chunks = append(chunks, chunk)
+		delete(r.unpacked, pc)
+		if len(packs) == 0 || len(packs[len(packs)-1].content)+len(content) > r.chunkSize {
+			packs = append(packs, pack{})
+		}
+		p := &packs[len(packs)-1]
+		pc.Offset = len(p.content)
+		p.content = append(p.content, content...)
+		p.chunks = append(p.chunks, pc)
+	}
+	r.mapsLock.Lock()
+	for pc := range r.unpacked {
+		if hash, isInline := r.inlineHashes[pc]; isInline {
+			if r.inlineChunks[string(hash)] == Chunk(pc) {
+				delete(r.inlineChunks, string(hash))
 			}
-			prev = NewTempChunk(buff[:r.chunkSize])
-			temp = NewTempChunk(buff[r.chunkSize:])
-		} else {
-			temp = NewTempChunk(buff)
+			delete(r.inlineHashes, pc)
+		}
+	}
+	r.mapsLock.Unlock()
+	r.unpacked = make(map[*PackedChunk][]byte)
+	for _, p := range packs {
+		temp := NewTempChunk(p.content)
+		hashes := chunkHashes{Fp: r.fingerprint(p.content), Sk: r.sketchChunk(p.content), Strong: r.strongHash(p.content)}
+		c := r.storeChunk(temp, hashes, version, last, storeQueue, nil, p.content)
+		logger.Debugf("add new pack %d of %d chunks", c.GetId(), len(p.chunks))
+		for _, pc := range p.chunks {
+			pc.Id = c.Id
 		}
-		chunks = append(chunks, r.encodeTempChunks(prev, temp, version, &last, storeQueue)...)
 	}
-	return chunks, last
+}
+
+// storeChunk attributes an Id to the given full chunk, saves it into the repo
+// maps and sends it to the store worker. If d is not nil, the chunk is stored
+// as a delta, content being its patch.
+func (r *Repo) storeChunk(temp BufferedChunk, hashes chunkHashes, version int, last *uint64, storeQueue chan<- chunkData, d *storedDelta, content []byte) *StoredChunk {
+	id := &ChunkId{Ver: version, Idx: *last}
+	*last++
+	r.fingerprints[hashes.Fp] = id
+	r.strongHashes[*id] = hashes.Strong
+	r.chunkCache.Set(id, temp.Bytes())
+	r.mapsLock.Lock()
+	// the content must be loadable as soon as the chunk can be found
+	r.pendingChunks[*id] = temp.Bytes()
+	r.sketches.Set(hashes.Sk, id)
+	if d != nil {
+		r.storedDeltas[*id] = *d
+		hashes.Source, hashes.Codec, hashes.Depth = d.Source, d.Codec, d.Depth
+	}
+	r.mapsLock.Unlock()
+	storeQueue <- chunkData{
+		hashes:  hashes,
+		content: content,
+		id:      id,
+	}
+	return r.newStoredChunk(id, temp.Len())
 }
 
 func (r *Repo) restoreStream(stream io.WriteCloser, recipe []Chunk) {
+	if r.jobs > 1 {
+		r.restorePipeline(stream, recipe)
+		return
+	}
 	for _, c := range recipe {
 		if n, err := io.Copy(stream, c.Reader()); err != nil {
 			logger.Errorf("copying to stream, read %d bytes from chunk: %s", n, err)
@@ -761,19 +1537,34 @@ func (r *Repo) restoreStream(stream io.WriteCloser, recipe []Chunk) {
 
 func (r *Repo) storeRecipe(version int, recipe []Chunk) {
 	logger.Info("store recipe")
-	dest := filepath.Join(r.path, fmt.Sprintf(versionFmt, version), recipeName)
-	storeDelta(r.recipeRaw, recipe, dest, r.differ, r.chunkWriteWrapper)
+	r.storeDelta(r.recipeRaw, recipe, version, recipeName, &r.recipeChain)
 }
 
 func (r *Repo) loadRecipes(versions []string, wg *sync.WaitGroup) {
 	logger.Info("load previous recipies")
 	var recipe []Chunk
-	r.recipeRaw = loadDeltas(&recipe, versions, r.patcher, r.chunkReadWrapper, recipeName)
+	// the inline chunks of the last version are taken from the loaded recipe,
+	// so that they are the same as its chunks
+	loaded := func(version string, raw []byte) {
+		if version == versions[len(versions)-1] {
+			return
+		}
+		r.loadInlineChunks(version, func() (recipe []Chunk) {
+			if err := gob.NewDecoder(bytes.NewReader(raw)).Decode(&recipe); err != nil {
+				logger.Panic("inline chunks recipe ", err)
+			}
+			return
+		})
+	}
+	r.recipeRaw, r.recipeChain = loadDeltas(&recipe, versions, r.legacyVersions, r.codecPatcher, r.readWrapper(), recipeName, loaded)
 	for _, c := range recipe {
 		if rc, isRepo := c.(RepoChunk); isRepo {
 			rc.SetRepo(r)
 		}
 	}
+	if len(versions) > 0 {
+		r.loadInlineChunks(versions[len(versions)-1], func() []Chunk { return recipe })
+	}
 	r.recipe = recipe
 	wg.Done()
 }
@@ -19,18 +19,25 @@ package repo
 
 import (
 	"bytes"
+	"encoding/gob"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"io/ioutil"
 	"log"
+	"math/rand"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/chmduquesne/rollinghash/rabinkarp64"
+	"github.com/n-peugnet/dna-backup/chunker"
 	"github.com/n-peugnet/dna-backup/delta"
+	"github.com/n-peugnet/dna-backup/export"
 	"github.com/n-peugnet/dna-backup/logger"
 	"github.com/n-peugnet/dna-backup/sketch"
 	"github.com/n-peugnet/dna-backup/testutils"
@@ -142,12 +149,13 @@ func (r *Repo) hashChunks(chunks []IdentifiedChunk) {
 }
 
 // hashChunk calculates the hashes for a chunk and store them in th repo hashmaps.
-func (r *Repo) hashChunk(id *ChunkId, reader io.Reader) (fp uint64, sk []uint64) {
+func (r *Repo) hashChunk(id *ChunkId, reader io.Reader) (fp uint64, sk []uint64, strong []byte) {
 	var buffSk bytes.Buffer
 	var buffFp bytes.Buffer
 	var wg sync.WaitGroup
 	reader = io.TeeReader(reader, &buffSk)
 	io.Copy(&buffFp, reader)
+	strong = r.strongHash(buffFp.Bytes())
 	wg.Add(2)
 	go r.makeFingerprint(id, &buffFp, &wg, &fp)
 	go r.makeSketch(id, &buffSk, &wg, &sk)
@@ -157,6 +165,7 @@ func (r *Repo) hashChunk(id *ChunkId, reader io.Reader) (fp uint64, sk []uint64)
 	}
 	r.fingerprints[fp] = id
 	r.sketches.Set(sk, id)
+	r.strongHashes[*id] = strong
 	return
 }
 
@@ -336,7 +345,8 @@ func TestBsdiff(t *testing.T) {
 	storeQueue := make(chan chunkData, 10)
 	storeEnd := make(chan bool)
 	go repo.storageWorker(newVersion, storeQueue, storeEnd)
-	recipe, _ := repo.matchStream(reader, storeQueue, newVersion, 0)
+	store := &commitStore{repo: repo, version: newVersion, queue: storeQueue}
+	recipe := repo.streamMatcher().Match(reader, store)
 	close(storeQueue)
 	<-storeEnd
 	newChunks := extractDeltaChunks(recipe)
@@ -352,12 +362,10 @@ func TestBsdiff(t *testing.T) {
 func TestCommitZlib(t *testing.T) {
 	dest := t.TempDir()
 	source := filepath.Join("testdata", "logs")
-	expected := filepath.Join("testdata", "repo_8k_zlib")
+	expected := filepath.Join("testdata", "repo_8k_zlib_current")
 	repo := NewRepo(dest, 8<<10)
 	repo.patcher = delta.Fdelta{}
 	repo.differ = delta.Fdelta{}
-	repo.chunkReadWrapper = utils.ZlibReader
-	repo.chunkWriteWrapper = utils.ZlibWriter
 
 	repo.Commit(source)
 	assertSameTree(t, assertCompatibleRepoFile, expected, dest, "Commit")
@@ -372,13 +380,86 @@ func TestRestoreZlib(t *testing.T) {
 	repo := NewRepo(source, 8<<10)
 	repo.patcher = delta.Fdelta{}
 	repo.differ = delta.Fdelta{}
-	repo.chunkReadWrapper = utils.ZlibReader
-	repo.chunkWriteWrapper = utils.ZlibWriter
 
 	repo.Restore(dest)
 	assertSameTree(t, testutils.AssertSameFile, expected, dest, "Restore")
 }
 
+// copyDir copies the content of the given directory into dest.
+func copyDir(t *testing.T, src string, dest string) {
+	err := filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return os.MkdirAll(filepath.Join(dest, rel), 0775)
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(filepath.Join(dest, rel), content, 0664)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestLegacyRepo commits new versions in a repo created before the config
+// existed, which must keep the legacy parameters whatever has been set.
+func TestLegacyRepo(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	temp := t.TempDir()
+	copyDir(t, filepath.Join("testdata", "repo_8k_zlib"), temp)
+	versions := writeVersions(t, filepath.Join("testdata", "logs", "3", "indexingTreeTest.log"), 2)
+	for _, source := range versions {
+		repo := NewRepo(temp, 8<<10)
+		if err := repo.SetCompression(utils.CompressionZstd, 0); err != nil {
+			t.Fatal(err)
+		}
+		if err := repo.SetChunker(chunker.FastCDCName); err != nil {
+			t.Fatal(err)
+		}
+		repo.Commit(source)
+		dest := t.TempDir()
+		NewRepo(temp, 8<<10).Restore(dest)
+		assertSameTree(t, testutils.AssertSameFile, source, dest, "Legacy repo")
+	}
+	repo := NewRepo(temp, 8<<10)
+	repo.loadVersions()
+	repo.loadConfig()
+	testutils.AssertSame(t, legacyConfig(1), repo.config(), "Stored config")
+}
+
+// TestLegacyRecipe loads the recipe of a repo created before the config
+// existed, whose chunks are not tagged and whose deltas do not have codec ID.
+func TestLegacyRecipe(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	repo := NewRepo(filepath.Join("testdata", "repo_8k_zlib"), 8<<10)
+	repo.loadVersions()
+	repo.loadConfig()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	repo.loadRecipes(repo.versions, &wg)
+	reader, writer := io.Pipe()
+	go repo.restoreStream(writer, repo.recipe)
+	actual, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := io.ReadAll(getDataStream(filepath.Join("testdata", "logs"), concatFiles))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutils.AssertSame(t, expected, actual, "Legacy stream")
+}
+
 func TestRoundtrip(t *testing.T) {
 	logger.SetLevel(2)
 	defer logger.SetLevel(4)
@@ -397,6 +478,947 @@ func TestRoundtrip(t *testing.T) {
 	assertSameTree(t, assertCompatibleRepoFile, source, dest, "Commit")
 }
 
+func TestEncryptedRoundtrip(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	temp := t.TempDir()
+	dest := t.TempDir()
+	source := filepath.Join("testdata", "logs")
+	secret := []byte("passphrase")
+	repo1 := NewRepo(temp, 8<<10)
+	repo1.SetSecret(secret)
+	repo1.Commit(source)
+
+	// stored data must not be readable without the key
+	repo2 := NewRepo(temp, 8<<10)
+	in, err := os.Open((&ChunkId{0, 0}).Path(temp))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+	var content []byte
+	rc, err := repo2.chunkReadWrapper(in)
+	if err == nil {
+		content, err = io.ReadAll(rc)
+	}
+
+	repo2.SetSecret(secret)
+	repo2.Restore(dest)
+	assertSameTree(t, testutils.AssertSameFile, source, dest, "Encrypted")
+	expected, _ := io.ReadAll(repo2.LoadChunkContent(&ChunkId{0, 0}))
+	if err == nil && bytes.Equal(expected, content) {
+		t.Error("chunk should not be readable without decryption")
+	}
+
+	// neither must its metadata
+	for _, name := range []string{hashesName, inlineName} {
+		file, err := os.Open(filepath.Join(temp, fmt.Sprintf(versionFmt, 0), name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var h chunkHashes
+		if err = gob.NewDecoder(file).Decode(&h); err == nil {
+			t.Errorf("%s should not be readable without decryption", name)
+		}
+		file.Close()
+	}
+}
+
+func TestKeyedHashes(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	source := filepath.Join("testdata", "logs")
+	var repos []*Repo
+	for _, secret := range [][]byte{nil, []byte("first"), []byte("second")} {
+		temp := t.TempDir()
+		repo := NewRepo(temp, 8<<10)
+		repo.SetSecret(secret)
+		repo.Commit(source)
+		repos = append(repos, repo)
+	}
+	for i, r1 := range repos {
+		for _, r2 := range repos[i+1:] {
+			for fp := range r1.fingerprints {
+				if _, exists := r2.fingerprints[fp]; exists {
+					t.Errorf("fingerprint %d should depend on the key", fp)
+				}
+			}
+			for sk := range r1.sketches {
+				if _, exists := r2.sketches[sk]; exists {
+					t.Errorf("sketch %d should depend on the key", sk)
+				}
+			}
+			for id, strong := range r1.strongHashes {
+				if bytes.Equal(strong, r2.strongHashes[id]) {
+					t.Errorf("strong hash of %d should depend on the key", id)
+				}
+			}
+		}
+	}
+	// keyed hashes must still deduplicate the unchanged data
+	repo := NewRepo(repos[1].path, 8<<10)
+	repo.SetSecret([]byte("first"))
+	repo.Commit(source)
+	chunks, err := os.ReadDir(filepath.Join(repo.path, fmt.Sprintf(versionFmt, 1), chunksName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutils.AssertLen(t, 0, chunks, "Second version chunks")
+}
+
+func TestCompressions(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	source := filepath.Join("testdata", "logs")
+	for _, c := range []config{
+		{Compression: utils.CompressionNone, Sketcher: sketch.RegionName, Chunker: chunker.FixedName},
+		{Compression: utils.CompressionZstd, CompressionLevel: 19, Sketcher: sketch.RegionName, Chunker: chunker.FixedName},
+		{Compression: utils.CompressionXz, Sketcher: sketch.RegionName, Chunker: chunker.FixedName},
+	} {
+		t.Run(c.Compression, func(t *testing.T) {
+			temp := t.TempDir()
+			dest := t.TempDir()
+			repo1 := NewRepo(temp, 8<<10)
+			if err := repo1.SetCompression(c.Compression, c.CompressionLevel); err != nil {
+				t.Fatal(err)
+			}
+			repo1.Commit(source)
+			// the compression must be loaded from the repo config
+			repo2 := NewRepo(temp, 8<<10)
+			repo2.Restore(dest)
+			testutils.AssertSame(t, c, repo2.config(), "Config")
+			assertSameTree(t, testutils.AssertSameFile, source, dest, "Compression")
+		})
+	}
+}
+
+func TestLegacyConfig(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	temp := t.TempDir()
+	NewRepo(temp, 8<<10).Commit(filepath.Join("testdata", "logs"))
+	// a repo with a version but no config has been created before it existed
+	if err := os.Remove(filepath.Join(temp, configName)); err != nil {
+		t.Fatal(err)
+	}
+	repo := NewRepo(temp, 8<<10)
+	if err := repo.SetCompression(utils.CompressionZstd, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.SetSketcher(sketch.GearName); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.SetChunker(chunker.FastCDCName); err != nil {
+		t.Fatal(err)
+	}
+	repo.loadVersions()
+	repo.loadConfig()
+	testutils.AssertSame(t, legacyConfig(1), repo.config(), "Legacy config")
+	if _, err := os.Stat(filepath.Join(temp, configName)); !errors.Is(err, fs.ErrNotExist) {
+		t.Error("the config should only be stored by the next commit")
+	}
+	repo.storeMissingConfig()
+	stored := NewRepo(temp, 8<<10)
+	stored.loadVersions()
+	stored.loadConfig()
+	testutils.AssertSame(t, legacyConfig(1), stored.config(), "Stored config")
+}
+
+func TestSketchers(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	versions := writeVersions(t, filepath.Join("testdata", "logs", "3", "indexingTreeTest.log"), 2)
+	for _, name := range []string{sketch.RegionName, sketch.TransformName, sketch.GearName} {
+		t.Run(name, func(t *testing.T) {
+			temp := t.TempDir()
+			dest := t.TempDir()
+			repo1 := NewRepo(temp, 8<<10)
+			if err := repo1.SetSketcher(name); err != nil {
+				t.Fatal(err)
+			}
+			repo1.Commit(versions[0])
+			// the sketcher must be loaded from the repo config
+			repo2 := NewRepo(temp, 8<<10)
+			repo2.Commit(versions[1])
+			testutils.AssertSame(t, name, repo2.config().Sketcher, "Sketcher")
+			repo3 := NewRepo(temp, 8<<10)
+			repo3.Restore(dest)
+			if len(extractDeltaChunks(repo3.recipe)) == 0 {
+				t.Error("similar chunks of the second version should be delta-encoded")
+			}
+			assertSameTree(t, testutils.AssertSameFile, versions[1], dest, "Sketcher")
+		})
+	}
+	if err := NewRepo(t.TempDir(), 8<<10).SetSketcher("unknown"); err == nil {
+		t.Error("an unknown sketcher should return an error")
+	}
+}
+
+func TestContentDefinedChunking(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	temp := t.TempDir()
+	dest := t.TempDir()
+	content, err := os.ReadFile(filepath.Join("testdata", "logs", "3", "indexingTreeTest.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the second version has some bytes inserted in the middle of the file
+	pos := len(content) / 2
+	inserted := append(append(append([]byte{}, content[:pos]...), "inserted bytes"...), content[pos:]...)
+	var versions []string
+	for _, c := range [][]byte{content, inserted} {
+		dir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dir, "file.log"), c, 0644); err != nil {
+			t.Fatal(err)
+		}
+		versions = append(versions, dir)
+	}
+	for _, source := range versions {
+		repo := NewRepo(temp, 8<<10)
+		if err := repo.SetChunker(chunker.FastCDCName); err != nil {
+			t.Fatal(err)
+		}
+		repo.Commit(source)
+	}
+	repo := NewRepo(temp, 8<<10)
+	repo.Restore(dest)
+	assertSameTree(t, testutils.AssertSameFile, versions[1], dest, "Content-defined chunking")
+	testutils.AssertSame(t, chunker.FastCDCName, repo.config().Chunker, "Chunker")
+	var sized, changed int
+	for _, c := range repo.recipe {
+		if s, isStored := c.(*StoredChunk); isStored && s.Id.Ver == 0 {
+			if s.Size != 0 {
+				sized++
+			}
+			testutils.AssertSame(t, len(repo.loadChunkBytes(s.Id)), s.Len(), "Stored chunk length")
+		} else {
+			changed++
+		}
+	}
+	if sized == 0 {
+		t.Error("stored chunks should have variable sizes")
+	}
+	// the chunks around the insertion and the last partial one
+	if changed > 3 {
+		t.Errorf("%d chunks have changed after an insertion", changed)
+	}
+}
+
+func TestInlineChunks(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	temp := t.TempDir()
+	source := filepath.Join("testdata", "logs")
+	var recipes [][]string
+	commit := func(dir string, differ delta.Differ) *Repo {
+		repo := NewRepo(temp, 8<<10)
+		repo.differ = differ
+		// the recipe of the second version is entirely new, it must not be
+		// stored as a snapshot for the inline chunks of the first one to be kept
+		repo.SetCheckpointRatio(0)
+		repo.Commit(dir)
+		repo = NewRepo(temp, 8<<10)
+		repo.Restore(t.TempDir())
+		recipes = append(recipes, describe(repo.recipe))
+		return repo
+	}
+	repo := commit(source, delta.Fdelta{})
+	// the second version stores new chunks starting with the content of the
+	// partial chunks of the first one, so that they could be delta-encoded
+	// against them by the next versions
+	rand := rand.New(rand.NewSource(1))
+	extended := t.TempDir()
+	var partials int
+	for i, c := range repo.recipe {
+		if pc, isPacked := c.(*PackedChunk); isPacked {
+			content, _ := io.ReadAll(pc.Reader())
+			content = append(content, randomBytes(rand, repo.chunkSize)...)
+			os.WriteFile(filepath.Join(extended, fmt.Sprint(i)), content[:repo.chunkSize], 0644)
+			partials++
+		}
+	}
+	if partials == 0 {
+		t.Fatal("the first recipe should contain partial chunks")
+	}
+	commit(extended, delta.Fdelta{})
+	commit(source, delta.Fdelta{})
+	testutils.AssertSame(t, recipes[0], recipes[2], "Recipe of the same content")
+
+	// the delta chunks made by the previous differ are not reused by another
+	// one, but they are by the differ that made them
+	deltas := extractDeltaChunks(commit(source, delta.Bsdiff{}).recipe)
+	if len(deltas) == 0 {
+		t.Fatal("recipe should contain delta chunks")
+	}
+	for _, d := range deltas {
+		testutils.AssertSame(t, delta.BsdiffCodec, d.Codec, "Delta chunk codec")
+	}
+	testutils.AssertSame(t, recipes[3], describe(commit(source, delta.Bsdiff{}).recipe), "Recipe of the same differ")
+	for _, d := range extractDeltaChunks(commit(source, delta.Fdelta{}).recipe) {
+		testutils.AssertSame(t, delta.FdeltaCodec, d.Codec, "Delta chunk codec")
+	}
+}
+
+func TestTailPacking(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	temp := t.TempDir()
+	dest := t.TempDir()
+	rand := rand.New(rand.NewSource(1))
+	chunks := randomBytes(rand, 4*8<<10)
+	// the second version inserts small gaps between the chunks of the first one
+	var versions []string
+	for _, gap := range []int{0, 1 << 10} {
+		var content []byte
+		for i := 0; i < len(chunks); i += 8 << 10 {
+			content = append(content, chunks[i:i+8<<10]...)
+			content = append(content, randomBytes(rand, gap)...)
+		}
+		dir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dir, "file"), content, 0644); err != nil {
+			t.Fatal(err)
+		}
+		versions = append(versions, dir)
+	}
+	for _, source := range versions {
+		repo := NewRepo(temp, 8<<10)
+		repo.Commit(source)
+	}
+	repo := NewRepo(temp, 8<<10)
+	repo.Restore(dest)
+	assertSameTree(t, testutils.AssertSameFile, versions[1], dest, "Tail packing")
+	var packed int
+	for _, c := range repo.recipe {
+		if pc, isPacked := c.(*PackedChunk); isPacked {
+			testutils.AssertSame(t, ChunkId{Ver: 1, Idx: 0}, *pc.Id, "Pack id")
+			testutils.AssertSame(t, packed<<10, pc.Offset, "Packed chunk offset")
+			packed++
+		}
+	}
+	testutils.AssertSame(t, 4, packed, "Packed chunk count")
+	// the gaps are all stored in a single chunk file
+	files, err := os.ReadDir(filepath.Join(temp, fmt.Sprintf(versionFmt, 1), chunksName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutils.AssertSame(t, 1, len(files), "Chunk files of the second version")
+}
+
+func TestDuplicateFiles(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	temp := t.TempDir()
+	dest := t.TempDir()
+	source := t.TempDir()
+	rand := rand.New(rand.NewSource(1))
+	content := randomBytes(rand, 20000)
+	write := func(name string, content []byte) {
+		if err := os.WriteFile(filepath.Join(source, name), content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	commit := func() []os.DirEntry {
+		repo := NewRepo(temp, 8<<10)
+		repo.Commit(source)
+		files, err := os.ReadDir(filepath.Join(temp, fmt.Sprintf(versionFmt, len(repo.versions)), chunksName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return files
+	}
+	// the copy is not aligned on the chunks of the original
+	write("0", randomBytes(rand, 1000))
+	write("a", content)
+	write("b", content)
+	testutils.AssertSame(t, 3, len(commit()), "Chunk files of the first version")
+	write("0", randomBytes(rand, 1000))
+	write("c", content)
+	testutils.AssertSame(t, 1, len(commit()), "Chunk files of the second version")
+	repo := NewRepo(temp, 8<<10)
+	repo.Restore(dest)
+	assertSameTree(t, testutils.AssertSameFile, source, dest, "Duplicate files")
+	for _, f := range repo.files {
+		if f.Hash == nil {
+			t.Errorf("file %s should have a hash", f.Path)
+		}
+	}
+
+	// a file changed without changing its size is not hashed, as it would be
+	// read twice, unless another file has the same size
+	candidates := func() (names []string) {
+		repo := NewRepo(temp, 8<<10)
+		repo.Init()
+		for _, f := range repo.duplicateCandidates(listFiles(source), source, repo.outdatedFiles()) {
+			names = append(names, filepath.Base(f.Path))
+		}
+		return
+	}
+	write("0", randomBytes(rand, 1000))
+	testutils.AssertSame(t, []string{"a", "b", "c"}, candidates(), "Duplicate candidates")
+	write("d", randomBytes(rand, 1000))
+	testutils.AssertSame(t, []string{"0", "a", "b", "c", "d"}, candidates(), "Duplicate candidates")
+}
+
+func TestSkipUnchanged(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	temp := t.TempDir()
+	source := t.TempDir()
+	rand := rand.New(rand.NewSource(1))
+	// the files are dated in the past, otherwise they could have been modified
+	// during the commit and would never be considered unchanged by the next one
+	past := time.Now().Add(-time.Hour)
+	write := func(name string, content []byte) {
+		path := filepath.Join(source, name)
+		if err := os.WriteFile(path, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+		past = past.Add(time.Second)
+		if err := os.Chtimes(path, past, past); err != nil {
+			t.Fatal(err)
+		}
+	}
+	commit := func(skip bool) map[string][]byte {
+		repo := NewRepo(temp, 8<<10)
+		repo.SetSkipUnchanged(skip)
+		repo.Commit(source)
+		dest := t.TempDir()
+		NewRepo(temp, 8<<10).Restore(dest)
+		restored := make(map[string][]byte)
+		for _, name := range []string{"a", "b"} {
+			content, err := os.ReadFile(filepath.Join(dest, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			restored[name] = content
+		}
+		return restored
+	}
+	a := randomBytes(rand, 20000)
+	b := randomBytes(rand, 1000)
+	write("a", a)
+	write("b", b)
+	commit(false)
+
+	// a is modified without changing its size nor its modification time, so it
+	// is wrongly considered unchanged, which shows that it is not read
+	info, err := os.Stat(filepath.Join(source, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	write("a", randomBytes(rand, 20000))
+	if err = os.Chtimes(filepath.Join(source, "a"), info.ModTime(), info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	b = randomBytes(rand, 1000)
+	write("b", b)
+	restored := commit(true)
+	testutils.AssertSame(t, a, restored["a"], "Unchanged file content")
+	testutils.AssertSame(t, b, restored["b"], "Changed file content")
+
+	// without the fast path, all the files are read
+	a, err = os.ReadFile(filepath.Join(source, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored = commit(false)
+	testutils.AssertSame(t, a, restored["a"], "Read file content")
+
+	// a file modified after the start of the previous commit is always read, as
+	// it could have been modified again in the same timestamp after being read
+	path := filepath.Join(source, "a")
+	during := time.Now().Add(time.Minute)
+	if err = os.Chtimes(path, during, during); err != nil {
+		t.Fatal(err)
+	}
+	commit(true)
+	a = randomBytes(rand, 20000)
+	if err = os.WriteFile(path, a, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chtimes(path, during, during); err != nil {
+		t.Fatal(err)
+	}
+	restored = commit(true)
+	testutils.AssertSame(t, a, restored["a"], "Racily modified file content")
+}
+
+func TestDictionary(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	temp := t.TempDir()
+	dest := t.TempDir()
+	source := filepath.Join("testdata", "logs")
+	for i := 0; i < 2; i++ {
+		repo := NewRepo(temp, 8<<10)
+		if err := repo.SetCompression(utils.CompressionZstd, 0); err != nil {
+			t.Fatal(err)
+		}
+		repo.SetDictionarySize(16 << 10)
+		repo.Commit(source)
+	}
+	// the first version has no chunks to train the dictionary from
+	for i, expected := range []bool{false, true} {
+		_, err := os.Stat(filepath.Join(temp, fmt.Sprintf(versionFmt, i), dictionaryName))
+		if (err == nil) != expected {
+			t.Errorf("version %d: dictionary existence should be %t", i, expected)
+		}
+	}
+	repo := NewRepo(temp, 8<<10)
+	repo.Restore(dest)
+	testutils.AssertSame(t, 1, len(repo.dictionaries), "Dictionaries")
+	assertSameTree(t, testutils.AssertSameFile, source, dest, "Dictionary")
+}
+
+func TestDeltaGain(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	source := filepath.Join("testdata", "logs")
+	for _, gain := range []float64{0, 100} {
+		t.Run(fmt.Sprint(gain), func(t *testing.T) {
+			temp := t.TempDir()
+			dest := t.TempDir()
+			repo := NewRepo(temp, 8<<10)
+			repo.SetDeltaGain(gain)
+			repo.Commit(source)
+			stats := repo.deltaStats
+			repo = NewRepo(temp, 8<<10)
+			repo.Restore(dest)
+			assertSameTree(t, testutils.AssertSameFile, source, dest, "Delta gain")
+			deltas := extractDeltaChunks(repo.recipe)
+			if stats.Tried == 0 {
+				t.Fatal("some delta encodings should have been tried")
+			}
+			if gain == 100 && (len(deltas) > 0 || stats.Skipped != stats.Tried) {
+				t.Errorf("no delta should be kept, got %d, %+v", len(deltas), stats)
+			}
+			if gain == 0 && len(deltas) == 0 {
+				t.Error("deltas should be kept")
+			}
+		})
+	}
+}
+
+func TestFindSimilarChunks(t *testing.T) {
+	repo := NewRepo(t.TempDir(), 8<<10)
+	a := &ChunkId{Ver: 0, Idx: 0}
+	b := &ChunkId{Ver: 0, Idx: 1}
+	c := &ChunkId{Ver: 0, Idx: 2}
+	repo.sketches.Set([]uint64{1, 4}, a)
+	repo.sketches.Set([]uint64{1, 2}, b)
+	repo.sketches.Set([]uint64{3}, c)
+	testutils.AssertSame(t, []*ChunkId{b}, repo.findSimilarChunks([]uint64{1, 2, 3}, 1), "Best candidate")
+	testutils.AssertSame(t, []*ChunkId{b, a, c}, repo.findSimilarChunks([]uint64{1, 2, 3}, 4), "All candidates")
+	testutils.AssertLen(t, 0, repo.findSimilarChunks([]uint64{5}, 4), "No candidates")
+}
+
+func TestDeltaCandidates(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	source := filepath.Join("testdata", "logs")
+	var sizes []int
+	for _, count := range []int{1, 4} {
+		temp := t.TempDir()
+		dest := t.TempDir()
+		repo := NewRepo(temp, 8<<10)
+		repo.SetDeltaCandidates(count)
+		repo.Commit(source)
+		repo = NewRepo(temp, 8<<10)
+		repo.Restore(dest)
+		assertSameTree(t, testutils.AssertSameFile, source, dest, "Delta candidates")
+		var size int
+		for _, d := range extractDeltaChunks(repo.recipe) {
+			size += len(d.Patch)
+		}
+		sizes = append(sizes, size)
+	}
+	if sizes[1] > sizes[0] {
+		t.Errorf("patches with more candidates should not be bigger: %d > %d", sizes[1], sizes[0])
+	}
+}
+
+// writeVersions writes count versions of the given file in successive
+// directories, each one modifying a few bytes of the previous one.
+func writeVersions(t *testing.T, file string, count int) []string {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirs := make([]string, count)
+	for v := range dirs {
+		for i := v * 101; i < len(content); i += 2000 {
+			content[i] = '#'
+		}
+		dirs[v] = t.TempDir()
+		path := filepath.Join(dirs[v], filepath.Base(file))
+		if err := os.WriteFile(path, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+		// files modified during a commit are stored without their modification
+		// time, so they are dated in the past for the repo not to depend on it
+		past := time.Date(2021, 1, 1, 0, 0, v, 0, time.UTC)
+		if err := os.Chtimes(path, past, past); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dirs
+}
+
+func TestDeltaDepth(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	versions := writeVersions(t, filepath.Join("testdata", "logs", "3", "indexingTreeTest.log"), 4)
+	for _, maxDepth := range []int{1, 3} {
+		temp := t.TempDir()
+		dest := t.TempDir()
+		for _, source := range versions {
+			repo := NewRepo(temp, 8<<10)
+			repo.SetMaxDeltaDepth(maxDepth)
+			repo.Commit(source)
+		}
+		repo := NewRepo(temp, 8<<10)
+		repo.Restore(dest)
+		assertSameTree(t, testutils.AssertSameFile, versions[len(versions)-1], dest, "Delta depth")
+		deepest := 0
+		for id, d := range repo.storedDeltas {
+			if d.Depth >= maxDepth {
+				t.Errorf("max depth %d: stored delta %d has depth %d", maxDepth, id, d.Depth)
+			}
+			if d.Depth > deepest {
+				deepest = d.Depth
+			}
+		}
+		testutils.AssertSame(t, maxDepth-1, deepest, "Deepest stored delta")
+		for _, d := range extractDeltaChunks(repo.recipe) {
+			if depth := repo.chunkDepth(d.Source) + 1; depth > maxDepth {
+				t.Errorf("max depth %d: delta chunk has depth %d", maxDepth, depth)
+			}
+		}
+	}
+}
+
+// TestLargeStoredDeltas checks that the stored delta chunks larger than the
+// chunk size, made by the content-defined chunker, are restored whatever the
+// differ.
+func TestLargeStoredDeltas(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	versions := writeVersions(t, filepath.Join("testdata", "logs", "3", "indexingTreeTest.log"), 3)
+	temp := t.TempDir()
+	for _, source := range versions {
+		repo := NewRepo(temp, 8<<10)
+		if err := repo.SetChunker(chunker.FastCDCName); err != nil {
+			t.Fatal(err)
+		}
+		repo.differ = delta.Vcdiff{}
+		repo.SetMaxDeltaDepth(2)
+		repo.Commit(source)
+	}
+	repo := NewRepo(temp, 8<<10)
+	dest := t.TempDir()
+	repo.Restore(dest)
+	assertSameTree(t, testutils.AssertSameFile, versions[len(versions)-1], dest, "Large stored deltas restore")
+	var large int
+	for id := range repo.storedDeltas {
+		if len(repo.loadChunkBytes(&id)) > repo.chunkSize {
+			large++
+		}
+	}
+	if large == 0 {
+		t.Error("some stored delta chunks should be larger than the chunk size")
+	}
+}
+
+// writeSimilarBlocks writes a source in which each block of random chunks is
+// followed by slightly modified copies of its chunks, so that the chunks are
+// similar to the ones encoded a few jobs earlier, which may not be stored yet.
+func writeSimilarBlocks(t *testing.T) string {
+	rand := rand.New(rand.NewSource(1))
+	var content []byte
+	for len(content) < 1<<20 {
+		block := randomBytes(rand, 64*8<<10)
+		content = append(content, block...)
+		for i := 0; i < len(block); i += 8 << 10 {
+			block[i+rand.Intn(8<<10)]++
+		}
+		content = append(content, block...)
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "similar")
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	past := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(path, past, past); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestJobs(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	versions := writeVersions(t, filepath.Join("testdata", "logs", "3", "indexingTreeTest.log"), 3)
+	versions = append(versions, filepath.Join("testdata", "logs"), writeSimilarBlocks(t))
+	repos := make([]string, 2)
+	for i, jobs := range []int{1, 16} {
+		repos[i] = t.TempDir()
+		for _, source := range versions {
+			repo := NewRepo(repos[i], 8<<10)
+			repo.SetJobs(jobs)
+			repo.SetDeltaCandidates(2)
+			repo.SetMaxDeltaDepth(2)
+			repo.Commit(source)
+		}
+	}
+	// chunks are matched in order whatever the number of jobs, so the
+	// versions are the same
+	assertSameTree(t, testutils.AssertSameFile, repos[0], repos[1], "Jobs")
+	dest := t.TempDir()
+	NewRepo(repos[1], 8<<10).Restore(dest)
+	assertSameTree(t, testutils.AssertSameFile, versions[len(versions)-1], dest, "Jobs restore")
+}
+
+// TestPendingChunk checks that a new chunk can be loaded as soon as it can be
+// found by the encoding workers, even if the storage worker did not write it.
+func TestPendingChunk(t *testing.T) {
+	repo := NewRepo(t.TempDir(), 8<<10)
+	content := randomBytes(rand.New(rand.NewSource(1)), 8<<10)
+	hashes := chunkHashes{Fp: repo.fingerprint(content), Sk: repo.sketchChunk(content), Strong: repo.strongHash(content)}
+	queue := make(chan chunkData) // never read, as the storage worker is late
+	var last uint64
+	go repo.storeChunk(NewTempChunk(content), hashes, 0, &last, queue, nil, content)
+	var found bool
+	for !found {
+		repo.mapsLock.RLock()
+		found = len(repo.sketches[hashes.Sk[0]]) > 0
+		repo.mapsLock.RUnlock()
+	}
+	testutils.AssertSame(t, content, repo.loadChunkBytes(&ChunkId{Ver: 0, Idx: 0}), "Pending chunk content")
+	<-queue
+}
+
+func TestParallelRestore(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	// the last version holds deltas of chunks that are themselves deltas
+	versions := writeVersions(t, filepath.Join("testdata", "logs", "3", "indexingTreeTest.log"), 3)
+	versions = append([]string{filepath.Join("testdata", "logs")}, versions...)
+	temp := t.TempDir()
+	for _, source := range versions {
+		repo := NewRepo(temp, 8<<10)
+		repo.SetMaxDeltaDepth(2)
+		repo.Commit(source)
+	}
+	repo := NewRepo(temp, 8<<10)
+	repo.SetJobs(4)
+	dest := t.TempDir()
+	repo.Restore(dest)
+	assertSameTree(t, testutils.AssertSameFile, versions[len(versions)-1], dest, "Parallel restore")
+	if len(extractDeltaChunks(repo.recipe)) == 0 {
+		t.Error("the recipe should hold delta chunks")
+	}
+}
+
+func TestGroupChunks(t *testing.T) {
+	a, b := &ChunkId{Idx: 1}, &ChunkId{Idx: 2}
+	recipe := []Chunk{
+		&StoredChunk{Id: a},
+		&DeltaChunk{Source: b},
+		NewTempChunk([]byte("temp")),
+		&DeltaChunk{Source: a},
+		&PackedChunk{Id: b},
+		NewTempChunk([]byte("other")),
+	}
+	groups, entries := groupChunks(recipe)
+	testutils.AssertLen(t, 3, groups, "Groups")
+	testutils.AssertLen(t, len(recipe), entries, "Entries")
+	for i, e := range entries {
+		testutils.AssertSame(t, recipe[i], e.group.chunks[e.index], "Entry chunk")
+	}
+	testutils.AssertSame(t, a, groups[0].base, "First group base")
+	testutils.AssertLen(t, 2, groups[0].chunks, "First group")
+	testutils.AssertSame(t, b, groups[1].base, "Second group base")
+	testutils.AssertLen(t, 2, groups[1].chunks, "Second group")
+	testutils.AssertLen(t, 2, groups[2].chunks, "Group without base")
+}
+
+type bufferExporter struct {
+	chunks, recipe, files, dictionary, index bytes.Buffer
+	metadata                                 []export.Metadata
+}
+
+func (e *bufferExporter) ExportVersion(metadata export.Metadata, end chan<- bool) export.Input {
+	e.metadata = append(e.metadata, metadata)
+	go func() { end <- true }()
+	return export.Input{
+		Chunks:     utils.NopCloser(&e.chunks),
+		Recipe:     utils.NopCloser(&e.recipe),
+		Files:      utils.NopCloser(&e.files),
+		Dictionary: utils.NopCloser(&e.dictionary),
+		Index:      utils.NopCloser(&e.index),
+	}
+}
+
+func TestExportGroups(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	for _, chunkerName := range []string{chunker.FixedName, chunker.FastCDCName} {
+		t.Run(chunkerName, func(t *testing.T) {
+			temp := t.TempDir()
+			source := filepath.Join("testdata", "logs")
+			groupSize := 4 * 1020
+			repo := NewRepo(temp, 8<<10)
+			if err := repo.SetChunker(chunkerName); err != nil {
+				t.Fatal(err)
+			}
+			repo.Commit(source)
+			repo = NewRepo(temp, 8<<10)
+			repo.SetExportGroupSize(groupSize)
+			exporter := &bufferExporter{}
+			repo.Export(exporter)
+
+			var index exportIndex
+			in, err := repo.readWrapper()(&exporter.index)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = gob.NewDecoder(in).Decode(&index); err != nil {
+				t.Fatal(err)
+			}
+			chunks := repo.loadChunks(repo.versions)[0]
+			if len(index.Groups) < 2 || len(index.Groups) >= len(chunks) {
+				t.Fatalf("%d chunks should be compressed in several groups, got %d", len(chunks), len(index.Groups))
+			}
+			testutils.AssertSame(t, int64(0), int64(exporter.chunks.Len()%groupSize), "Chunks size modulo group size")
+			data := exporter.chunks.Bytes()
+			exported := make(map[ChunkId][]byte)
+			sizes := make(map[int]bool)
+			for i, c := range chunks {
+				group, offset, position := index.Locate(i)
+				g := index.Groups[group]
+				if g.Size > groupSize && len(g.Chunks) > 1 {
+					t.Errorf("group %d: size %d should fit in %d", group, g.Size, groupSize)
+				}
+				// only the group of the chunk is read
+				in, err := repo.readWrapper()(bytes.NewReader(data[offset : offset+int64(g.Size)]))
+				if err != nil {
+					t.Fatal(err)
+				}
+				content, err := io.ReadAll(in)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var expected bytes.Buffer
+				expected.ReadFrom(c.Reader())
+				testutils.AssertSame(t, expected.Len(), position.Length, fmt.Sprintf("Chunk %d length", i))
+				content = content[position.Offset : position.Offset+position.Length]
+				testutils.AssertSame(t, expected.Bytes(), content, fmt.Sprintf("Chunk %d", i))
+				exported[*c.GetId()] = content
+				sizes[len(content)] = true
+			}
+			if chunkerName == chunker.FastCDCName && len(sizes) < 2 {
+				t.Error("chunks should be of variable size")
+			}
+			// the partial chunks are restored from their exported pack
+			var packed int
+			for _, c := range repo.recipe {
+				if p, isPacked := c.(*PackedChunk); isPacked {
+					var expected bytes.Buffer
+					expected.ReadFrom(p.Reader())
+					testutils.AssertSame(t, expected.Bytes(), p.content(exported[*p.Id]), fmt.Sprintf("Packed chunk %v", *p))
+					packed++
+				}
+			}
+			if chunkerName == chunker.FixedName && packed == 0 {
+				t.Error("recipe should contain packed chunks")
+			}
+		})
+	}
+}
+
+func TestMixedCodecs(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	temp := t.TempDir()
+	dest := t.TempDir()
+	source := filepath.Join("testdata", "logs")
+	repo1 := NewRepo(temp, 8<<10)
+	repo1.differ = delta.Bsdiff{}
+	if err := repo1.SetCompression(utils.CompressionXz, 0); err != nil {
+		t.Fatal(err)
+	}
+	repo1.Commit(source)
+
+	// the compression of the repo is changed for the next versions
+	repo2 := NewRepo(temp, 8<<10)
+	if err := repo2.SetCompression(utils.CompressionZstd, 0); err != nil {
+		t.Fatal(err)
+	}
+	repo2.storeConfig(filepath.Join(temp, configName))
+	repo2.Commit(source)
+
+	// codecs must be read from the data, not from the repo defaults: chunks of
+	// the first version are compressed with xz and the recipe delta is made with
+	// Bsdiff, while the ones of the second version use zstd and Fdelta.
+	repo3 := NewRepo(temp, 8<<10)
+	repo3.differ = delta.Vcdiff{}
+	repo3.patcher = delta.Vcdiff{}
+	repo3.Restore(dest)
+	assertSameTree(t, testutils.AssertSameFile, source, dest, "Mixed codecs")
+	deltas := extractDeltaChunks(repo3.recipe)
+	if len(deltas) == 0 {
+		t.Fatal("recipe should contain delta chunks")
+	}
+	for _, d := range deltas {
+		testutils.AssertSame(t, delta.FdeltaCodec, d.Codec, "Delta chunk codec")
+	}
+}
+
+func TestCheckpoint(t *testing.T) {
+	logger.SetLevel(2)
+	defer logger.SetLevel(4)
+	temp := t.TempDir()
+	dest := t.TempDir()
+	source := filepath.Join("testdata", "logs")
+	for i := 0; i < 3; i++ {
+		repo := NewRepo(temp, 8<<10)
+		repo.SetCheckpointInterval(1)
+		repo.Commit(source)
+	}
+	exporter := &bufferExporter{}
+	NewRepo(temp, 8<<10).Export(exporter)
+	for i, expected := range []bool{false, true, false} {
+		version := filepath.Join(temp, fmt.Sprintf(versionFmt, i))
+		for _, name := range []string{recipeName, filesName} {
+			if _, snapshot := metadataName(version, name); snapshot != expected {
+				t.Errorf("version %d: %s snapshot should be %t", i, name, expected)
+			}
+		}
+		testutils.AssertSame(t, export.Metadata{RecipeSnapshot: expected, FilesSnapshot: expected}, exporter.metadata[i], fmt.Sprintf("Version %d exported metadata", i))
+	}
+	// deltas before the checkpoint must not be needed anymore
+	for _, name := range []string{recipeName, filesName} {
+		os.Remove(filepath.Join(temp, fmt.Sprintf(versionFmt, 0), name))
+	}
+	repo := NewRepo(temp, 8<<10)
+	repo.Restore(dest)
+	assertSameTree(t, testutils.AssertSameFile, source, dest, "Checkpoint")
+	testutils.AssertSame(t, 1, repo.recipeChain.Length, "Recipe chain length")
+	// the delta chunks of the first version that are still used are kept as
+	// inline chunks by the snapshot
+	deltas := extractDeltaChunks(repo.recipe)
+	if len(deltas) == 0 {
+		t.Fatal("recipe should contain delta chunks")
+	}
+	for _, d := range deltas {
+		if _, known := repo.inlineHashes[d]; !known {
+			t.Errorf("delta chunk of %v should be known", *d.Source)
+		}
+	}
+}
+
 func TestHashes(t *testing.T) {
 	dest := t.TempDir()
 	source := filepath.Join("testdata", "repo_8k_zlib")
@@ -405,18 +1427,16 @@ func TestHashes(t *testing.T) {
 	storeEnd := make(chan bool)
 
 	repo1 := NewRepo(source, 8<<10)
-	repo1.chunkReadWrapper = utils.ZlibReader
-	repo1.chunkWriteWrapper = utils.ZlibWriter
 	repo1.versions = []string{filepath.Join(source, "00000")}
 	chunks := repo1.loadChunks(repo1.versions)
 	for _, c := range chunks[0] {
-		fp, sk := repo1.hashChunk(c.GetId(), c.Reader())
+		fp, sk, strong := repo1.hashChunk(c.GetId(), c.Reader())
 		content, err := io.ReadAll(c.Reader())
 		if err != nil {
 			t.Error(err)
 		}
 		storeQueue <- chunkData{
-			hashes:  chunkHashes{fp, sk},
+			hashes:  chunkHashes{Fp: fp, Sk: sk, Strong: strong},
 			content: content,
 			id:      c.GetId(),
 		}
@@ -436,6 +1456,40 @@ func TestHashes(t *testing.T) {
 	wg.Wait()
 	testutils.AssertSame(t, repo1.fingerprints, repo2.fingerprints, "Fingerprint maps")
 	testutils.AssertSame(t, repo1.sketches, repo2.sketches, "Sketches maps")
+	testutils.AssertSame(t, repo1.strongHashes, repo2.strongHashes, "Strong hashes maps")
+}
+
+func TestFingerprintCollision(t *testing.T) {
+	var output bytes.Buffer
+	logger.SetOutput(&output)
+	defer logger.SetOutput(os.Stderr)
+	repo := NewRepo(t.TempDir(), 8<<10)
+	stored := make([]byte, repo.chunkSize)
+	data := bytes.Repeat([]byte("collision"), repo.chunkSize/8)[:repo.chunkSize]
+	id := &ChunkId{Ver: 0, Idx: 0}
+	repo.chunkCache.Set(id, stored)
+	repo.strongHashes[*id] = repo.strongHash(stored)
+	hasher := rabinkarp64.NewFromPol(repo.pol)
+	hasher.Write(data)
+	// simulate a collision of the rolling hash
+	repo.fingerprints[hasher.Sum64()] = id
+
+	storeQueue := make(chan chunkData, 16)
+	go func() {
+		for range storeQueue {
+		}
+	}()
+	store := &commitStore{repo: repo, version: 1, queue: storeQueue}
+	recipe := repo.streamMatcher().Match(bytes.NewReader(data), store)
+	close(storeQueue)
+	for _, c := range recipe {
+		if s, isStored := c.(*StoredChunk); isStored && *s.Id == *id {
+			t.Error("colliding chunk should not be referenced")
+		}
+	}
+	if !strings.Contains(output.String(), "fingerprint collision with chunk {0 0}") {
+		t.Errorf("log should contain a warning for the collision, actual %q", &output)
+	}
 }
 
 func assertSameTree(t *testing.T, apply func(t *testing.T, expected string, actual string, prefix string), expected string, actual string, prefix string) {
@@ -462,16 +1516,10 @@ func assertSameTree(t *testing.T, apply func(t *testing.T, expected string, actu
 
 func assertCompatibleRepoFile(t *testing.T, expected string, actual string, prefix string) {
 	if filepath.Base(expected) == filesName {
-		// TODO: Check Filelist file
-		// eFiles := loadFileList(expected)
-		// aFiles := loadFileList(actual)
-		// testutils.AssertLen(t, len(eFiles), aFiles, prefix)
-		// for i, eFile := range eFiles {
-		// 	eFile.Path = filepath.FromSlash(eFile.Path)
-		// 	if eFile != aFiles[i] {
-		// 		t.Fatal(prefix, "file entry do not match:", aFiles[i], ", expected:", eFile)
-		// 	}
-		// }
+		wrapper := NewRepo(t.TempDir(), 8<<10).readWrapper()
+		eOps := loadFileOps(filepath.Dir(expected), filesName, wrapper)
+		aOps := loadFileOps(filepath.Dir(actual), filesName, wrapper)
+		testutils.AssertSame(t, withoutFileStats(eOps), withoutFileStats(aOps), prefix+" file list")
 	} else if filepath.Base(expected) == recipeName {
 		// TODO: Check Recipe files
 		// eRecipe := loadRecipe(expected)
@@ -479,12 +1527,48 @@ func assertCompatibleRepoFile(t *testing.T, expected string, actual string, pref
 		// testutils.AssertSame(t, eRecipe, aRecipe, prefix+"recipe")
 	} else if filepath.Base(expected) == hashesName {
 		// Hashes file is checked in TestHashes
+	} else if filepath.Base(expected) == inlineName {
+		testutils.AssertSame(t, loadInlineRefs(t, expected), loadInlineRefs(t, actual), prefix+" inline chunks")
 	} else {
 		// Chunk content file
 		testutils.AssertSameFile(t, expected, actual, prefix)
 	}
 }
 
+// withoutFileStats removes the fields of the given operations that depend on
+// the checkout of the source files.
+func withoutFileStats(ops []fileOp) []fileOp {
+	for i := range ops {
+		ops[i].ModTime = 0
+		ops[i].Inode = 0
+	}
+	return ops
+}
+
+// loadInlineRefs returns the references to the inline chunks of a recipe
+// stored in the given file.
+func loadInlineRefs(t *testing.T, path string) (refs []inlineChunk) {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	in, err := NewRepo(t.TempDir(), 8<<10).readWrapper()(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoder := gob.NewDecoder(in)
+	for {
+		var c inlineChunk
+		if err = decoder.Decode(&c); err == io.EOF {
+			return
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		refs = append(refs, c)
+	}
+}
+
 func assertChunkContent(t *testing.T, expected []byte, c Chunk, prefix string) {
 	buf, err := io.ReadAll(c.Reader())
 	if err != nil {
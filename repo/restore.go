@@ -0,0 +1,153 @@
+/* Copyright (C) 2021 Nicolas Peugnet <n.peugnet@free.fr>
+
+   This file is part of dna-backup.
+
+   dna-backup is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   dna-backup is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with dna-backup.  If not, see <https://www.gnu.org/licenses/>. */
+
+package repo
+
+import (
+	"io"
+
+	"github.com/n-peugnet/dna-backup/logger"
+)
+
+// restoreWindow is the number of entries of the recipe, per job, that are
+// decoded at once during a restore.
+const restoreWindow = 16
+
+// restoreGroup is a group of entries of a window of the recipe that need the
+// same stored chunk to be decoded: the chunk itself, the pack of a packed chunk
+// or the source of a delta chunk. This base chunk is thus only loaded once for
+// the whole group.
+type restoreGroup struct {
+	base     *ChunkId // nil for the entries that do not need a stored chunk
+	chunks   []Chunk
+	contents [][]byte
+	decoded  chan bool
+}
+
+// restoreEntry is an entry of a window of the recipe, decoded by its group.
+type restoreEntry struct {
+	group *restoreGroup
+	index int
+}
+
+// chunkBase returns the id of the stored chunk needed to decode the given
+// chunk, or nil if it does not need one.
+func chunkBase(c Chunk) *ChunkId {
+	switch c := c.(type) {
+	case *StoredChunk:
+		return c.Id
+	case *PackedChunk:
+		return c.Id
+	case *DeltaChunk:
+		return c.Source
+	}
+	return nil
+}
+
+// groupChunks splits the given entries of a recipe by the stored chunk needed
+// to decode them. The groups are in the order of their first entry.
+func groupChunks(chunks []Chunk) (groups []*restoreGroup, entries []restoreEntry) {
+	byBase := make(map[ChunkId]*restoreGroup)
+	var others *restoreGroup
+	for _, c := range chunks {
+		base := chunkBase(c)
+		var g *restoreGroup
+		if base == nil {
+			g = others
+		} else {
+			g = byBase[*base]
+		}
+		if g == nil {
+			g = &restoreGroup{base: base, decoded: make(chan bool)}
+			if base == nil {
+				others = g
+			} else {
+				byBase[*base] = g
+			}
+			groups = append(groups, g)
+		}
+		entries = append(entries, restoreEntry{group: g, index: len(g.chunks)})
+		g.chunks = append(g.chunks, c)
+	}
+	return
+}
+
+// decode decodes the content of each chunk of the group.
+func (g *restoreGroup) decode(r *Repo) {
+	var base []byte
+	if g.base != nil {
+		base = r.loadChunkBytes(g.base)
+	}
+	g.contents = make([][]byte, len(g.chunks))
+	for i, c := range g.chunks {
+		switch c := c.(type) {
+		case *StoredChunk:
+			g.contents[i] = base
+		case *PackedChunk:
+			g.contents[i] = c.content(base)
+		case *DeltaChunk:
+			g.contents[i] = c.content(base)
+		default:
+			content, err := io.ReadAll(c.Reader())
+			if err != nil {
+				logger.Error("restore chunk ", err)
+			}
+			g.contents[i] = content
+		}
+	}
+	close(g.decoded)
+}
+
+// restorePipeline is like restoreStream, but the chunks are decoded ahead of
+// the stream by up to jobs goroutines. The recipe is split in windows whose
+// entries are grouped by the stored chunk they need, each group being decoded
+// by a single goroutine. The decoded chunks are written in the order of the
+// recipe, while the next windows are being decoded.
+func (r *Repo) restorePipeline(stream io.WriteCloser, recipe []Chunk) {
+	windows := make(chan []restoreEntry, 1)
+	go func() {
+		workers := make(chan bool, r.jobs)
+		size := restoreWindow * r.jobs
+		for start := 0; start < len(recipe); start += size {
+			end := start + size
+			if end > len(recipe) {
+				end = len(recipe)
+			}
+			groups, entries := groupChunks(recipe[start:end])
+			for _, g := range groups {
+				workers <- true
+				go func(g *restoreGroup) {
+					g.decode(r)
+					<-workers
+				}(g)
+			}
+			windows <- entries
+		}
+		close(windows)
+	}()
+	for entries := range windows {
+		for _, e := range entries {
+			<-e.group.decoded
+			content := e.group.contents[e.index]
+			if n, err := stream.Write(content); err != nil {
+				logger.Errorf("copying to stream, written %d/%d bytes from chunk: %s", n, len(content), err)
+			}
+			e.group.contents[e.index] = nil
+		}
+	}
+	stream.Close()
+}
@@ -0,0 +1,331 @@
+/* Copyright (C) 2021 Nicolas Peugnet <n.peugnet@free.fr>
+
+   This file is part of dna-backup.
+
+   dna-backup is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   dna-backup is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with dna-backup.  If not, see <https://www.gnu.org/licenses/>. */
+
+package repo
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/n-peugnet/dna-backup/delta"
+	"github.com/n-peugnet/dna-backup/logger"
+	"github.com/n-peugnet/dna-backup/utils"
+)
+
+// recipeIndex gives the chunks of a recipe holding any range of the stream it
+// describes.
+type recipeIndex struct {
+	recipe []Chunk
+	ends   []int64 // end offset of each chunk in the stream
+}
+
+func newRecipeIndex(recipe []Chunk) *recipeIndex {
+	x := &recipeIndex{}
+	x.add(recipe...)
+	return x
+}
+
+// len returns the length of the stream described by the recipe.
+func (x *recipeIndex) len() int64 {
+	if len(x.ends) == 0 {
+		return 0
+	}
+	return x.ends[len(x.ends)-1]
+}
+
+func (x *recipeIndex) add(chunks ...Chunk) {
+	end := x.len()
+	for _, c := range chunks {
+		end += int64(c.Len())
+		x.recipe = append(x.recipe, c)
+		x.ends = append(x.ends, end)
+	}
+}
+
+// slice returns the chunks holding the size bytes of the stream starting at
+// offset. The chunks at the boundaries of the range are cut if needed.
+func (x *recipeIndex) slice(offset int64, size int64) (chunks []Chunk) {
+	i := sort.Search(len(x.ends), func(i int) bool { return x.ends[i] > offset })
+	for ; size > 0 && i < len(x.recipe); i++ {
+		c := x.recipe[i]
+		start := offset - (x.ends[i] - int64(c.Len()))
+		n := int64(c.Len()) - start
+		if n > size {
+			n = size
+		}
+		chunks = append(chunks, sliceChunk(c, int(start), int(n)))
+		offset += n
+		size -= n
+	}
+	if size > 0 {
+		logger.Errorf("recipe range out of bounds by %d bytes", size)
+	}
+	return
+}
+
+// sliceChunk returns the part of the given chunk of the given size starting at
+// offset. Parts of stored chunks are referenced like packed chunks, the others
+// are copied.
+func sliceChunk(c Chunk, offset int, size int) Chunk {
+	if offset == 0 && size == c.Len() {
+		return c
+	}
+	switch c := c.(type) {
+	case *StoredChunk:
+		return &PackedChunk{repo: c.repo, Id: c.Id, Offset: offset, Size: size}
+	case *PackedChunk:
+		return &PackedChunk{repo: c.repo, Id: c.Id, Offset: c.Offset + offset, Size: size}
+	}
+	value := make([]byte, size)
+	reader := c.Reader()
+	if _, err := reader.Seek(int64(offset), io.SeekStart); err != nil {
+		logger.Panic(err)
+	}
+	if _, err := io.ReadFull(reader, value); err != nil {
+		logger.Panic(err)
+	}
+	return NewTempChunk(value)
+}
+
+// splicedFile is a file of the source whose content is not read during a
+// commit, as it is already in a recipe.
+type splicedFile struct {
+	hash   []byte
+	offset int64 // in the recipe of the previous version, or -1 if the content is the one of a preceding file of the source
+}
+
+// SetSkipUnchanged sets whether the files that have the same size, modification
+// time and inode as in the previous version are considered unchanged, and are
+// thus not read during a commit.
+func (r *Repo) SetSkipUnchanged(skip bool) {
+	r.skipUnchanged = skip
+}
+
+// smudgeRacyFiles resets the modification time of the files that may have been
+// modified during the commit started at the given time, so that they are not
+// considered unchanged by the next one. Their modification time could indeed
+// be the same before and after a change made after they have been read. As
+// some file systems store coarse timestamps, the start is rounded down to the
+// second.
+func smudgeRacyFiles(files []File, start time.Time) {
+	limit := start.Truncate(time.Second).UnixNano()
+	for i := range files {
+		if files[i].ModTime >= limit {
+			files[i].ModTime = 0
+		}
+	}
+}
+
+// outdatedFiles returns the indexes of the files of the previous version whose
+// recipe range holds delta chunks made by another differ than the current one.
+// As changing the differ of a repo applies to all its new delta chunks, these
+// files are not spliced but encoded again.
+func (r *Repo) outdatedFiles() map[int]bool {
+	outdated := make(map[int]bool)
+	var i int
+	var offset, end int64
+	for _, c := range r.recipe {
+		start := end
+		end += int64(c.Len())
+		d, isDelta := c.(*DeltaChunk)
+		if !isDelta || d.Codec == delta.IdOf(r.differ) {
+			continue
+		}
+		for ; i < len(r.files) && offset+r.files[i].Size <= start; i++ {
+			offset += r.files[i].Size
+		}
+		for j, o := i, offset; j < len(r.files) && o < end; j++ {
+			outdated[j] = true
+			o += r.files[j].Size
+		}
+	}
+	return outdated
+}
+
+// findUnchangedFiles adds the files of the given source that have not changed
+// since the previous version to spliced, by their path.
+func (r *Repo) findUnchangedFiles(files []File, source string, spliced map[string]splicedFile) {
+	outdated := r.outdatedFiles()
+	prev := make(map[string]int)
+	offsets := make([]int64, len(r.files))
+	var offset int64
+	for i, f := range r.files {
+		if !outdated[i] {
+			prev[f.Path] = i
+		}
+		offsets[i] = offset
+		offset += f.Size
+	}
+	for _, f := range files {
+		path, err := utils.Unprefix(f.Path, source)
+		if err != nil || f.Link != "" || f.ModTime == 0 {
+			continue
+		}
+		i, exists := prev[path]
+		if !exists {
+			continue
+		}
+		p := r.files[i]
+		if p.Link == "" && p.Size == f.Size && p.ModTime == f.ModTime && p.Inode == f.Inode {
+			spliced[f.Path] = splicedFile{hash: p.Hash, offset: offsets[i]}
+		}
+	}
+	logger.Infof("found %d unchanged files", len(spliced))
+}
+
+// knownFiles returns the offset of the content of the files of the previous
+// version in its recipe, by their hash.
+func (r *Repo) knownFiles(outdated map[int]bool) map[string]int64 {
+	known := make(map[string]int64)
+	var offset int64
+	for i, f := range r.files {
+		if _, exists := known[string(f.Hash)]; f.Hash != nil && f.Size > 0 && !exists && !outdated[i] {
+			known[string(f.Hash)] = offset
+		}
+		offset += f.Size
+	}
+	return known
+}
+
+// duplicateCandidates returns the files of the given source that may have the
+// same content as another one: a file of the source or a known file of the
+// previous version at another path having the same size. A file changed
+// without changing its size is thus not a candidate, as hashing it would read
+// it once more than needed.
+func (r *Repo) duplicateCandidates(files []File, source string, outdated map[int]bool) (candidates []File) {
+	prevSizes := make(map[int64]int)
+	prevPaths := make(map[string]int64)
+	for i, f := range r.files {
+		if f.Hash != nil && f.Size > 0 && !outdated[i] {
+			prevSizes[f.Size]++
+			prevPaths[f.Path] = f.Size
+		}
+	}
+	sizes := make(map[int64]int)
+	for _, f := range files {
+		sizes[f.Size]++
+	}
+	for _, f := range files {
+		if f.Link != "" || f.Size == 0 {
+			continue
+		}
+		others := prevSizes[f.Size]
+		if path, err := utils.Unprefix(f.Path, source); err == nil {
+			if size, exists := prevPaths[path]; exists && size == f.Size {
+				others--
+			}
+		}
+		if others > 0 || sizes[f.Size] > 1 {
+			candidates = append(candidates, f)
+		}
+	}
+	return
+}
+
+// findDuplicateFiles adds the files whose content is the same as the one of a
+// file of the previous version or of a preceding file of the list to spliced,
+// by their path. Only the candidates given by duplicateCandidates are hashed.
+func (r *Repo) findDuplicateFiles(files []File, source string, spliced map[string]splicedFile) {
+	outdated := r.outdatedFiles()
+	known := r.knownFiles(outdated)
+	seen := make(map[string]bool)
+	var count int
+	for _, f := range r.duplicateCandidates(files, source, outdated) {
+		if _, skipped := spliced[f.Path]; skipped {
+			continue
+		}
+		hash, err := r.hashFile(f)
+		if err != nil {
+			logger.Warning(err)
+			continue
+		}
+		if offset, exists := known[string(hash)]; exists {
+			spliced[f.Path] = splicedFile{hash: hash, offset: offset}
+		} else if seen[string(hash)] {
+			spliced[f.Path] = splicedFile{hash: hash, offset: -1}
+		} else {
+			seen[string(hash)] = true
+			continue
+		}
+		count++
+	}
+	logger.Infof("found %d duplicate files", count)
+}
+
+func (r *Repo) hashFile(f File) ([]byte, error) {
+	file, err := os.Open(f.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	hasher := r.newStrongHasher()
+	n, err := io.Copy(hasher, file)
+	if err != nil {
+		return nil, err
+	}
+	if n != f.Size {
+		return nil, fmt.Errorf("size of %s changed from %d to %d", f.Path, f.Size, n)
+	}
+	return hasher.Sum(nil), nil
+}
+
+// spliceFiles builds the recipe of all the files from the one of the stream,
+// which does not hold the spliced files, by inserting the recipe range of their
+// content at their position. The duplicate files whose original content has not
+// been found are removed from the list.
+func (r *Repo) spliceFiles(files []File, streamed []Chunk, spliced map[string]splicedFile) ([]Chunk, []File) {
+	if len(spliced) == 0 {
+		return streamed, files
+	}
+	prev := newRecipeIndex(r.recipe)
+	stream := newRecipeIndex(streamed)
+	recipe := newRecipeIndex(nil)
+	current := make(map[string]int64)
+	actual := make([]File, 0, len(files))
+	var start, end int64 // range of the stream not yet added to the recipe
+	for _, f := range files {
+		sf, isSpliced := spliced[f.Path]
+		if !isSpliced {
+			if _, exists := current[string(f.Hash)]; f.Hash != nil && !exists {
+				current[string(f.Hash)] = recipe.len() + end - start
+			}
+			end += f.Size
+			actual = append(actual, f)
+			continue
+		}
+		recipe.add(stream.slice(start, end-start)...)
+		start = end
+		if sf.offset >= 0 {
+			recipe.add(prev.slice(sf.offset, f.Size)...)
+		} else if offset, exists := current[string(sf.hash)]; exists {
+			recipe.add(recipe.slice(offset, f.Size)...)
+		} else {
+			logger.Errorf("original content of %s changed during the commit", f.Path)
+			continue
+		}
+		f.Hash = sf.hash
+		actual = append(actual, f)
+	}
+	recipe.add(stream.slice(start, end-start)...)
+	if end != stream.len() {
+		logger.Errorf("files size %d does not match stream size %d", end, stream.len())
+	}
+	return recipe.recipe, actual
+}
@@ -19,7 +19,6 @@ package sketch
 
 import (
 	"bytes"
-	"encoding/binary"
 	"io"
 
 	"github.com/chmduquesne/rollinghash/rabinkarp64"
@@ -41,9 +40,7 @@ const fBytes = 8
 func SketchChunk(r io.Reader, pol rabinkarp64.Pol, chunkSize int, wSize int, sfCount int, fCount int) (Sketch, error) {
 	var fSize = FeatureSize(chunkSize, sfCount, fCount)
 	var chunk bytes.Buffer
-	superfeatures := make([]uint64, 0, sfCount)
 	features := make([]uint64, 0, fCount*sfCount)
-	sfBuff := make([]byte, fBytes*fCount)
 	chunkLen, err := chunk.ReadFrom(r)
 	if err != nil {
 		logger.Panic(chunkLen, err)
@@ -58,16 +55,7 @@ func SketchChunk(r io.Reader, pol rabinkarp64.Pol, chunkSize int, wSize int, sfC
 		features = append(features, 0)
 		calcFeature(pol, &fBuff, wSize, fSize, &features[f])
 	}
-	hasher := rabinkarp64.NewFromPol(pol)
-	for sf := 0; sf < len(features)/fCount; sf++ {
-		for i := 0; i < fCount; i++ {
-			binary.LittleEndian.PutUint64(sfBuff[i*fBytes:(i+1)*fBytes], features[i+sf*fCount])
-		}
-		hasher.Reset()
-		hasher.Write(sfBuff)
-		superfeatures = append(superfeatures, hasher.Sum64())
-	}
-	return superfeatures, nil
+	return superFeatures(pol, features, sfCount, fCount), nil
 }
 
 func calcFeature(p rabinkarp64.Pol, r ReadByteReader, wSize int, fSize int, result *uint64) {
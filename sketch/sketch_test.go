@@ -18,6 +18,7 @@
 package sketch
 
 import (
+	"math/rand"
 	"os"
 	"path/filepath"
 	"reflect"
@@ -58,3 +59,136 @@ func TestSketchChunk(t *testing.T) {
 		t.Errorf("Sketch does not match, expected: %d, actual: %d", expected, sketch)
 	}
 }
+
+var sketcherNames = []string{RegionName, TransformName, GearName}
+
+// shift returns chunk whose content has been shifted by count bytes, like the
+// following chunk of a stream in which count bytes have been inserted.
+func shift(rand *rand.Rand, chunk []byte, count int) []byte {
+	inserted := make([]byte, count)
+	rand.Read(inserted)
+	return append(inserted, chunk[:len(chunk)-count]...)
+}
+
+// mutate returns a copy of chunk with count small edits: modifications,
+// insertions and deletions of a few bytes.
+func mutate(rand *rand.Rand, chunk []byte, count int) []byte {
+	result := append([]byte{}, chunk...)
+	for i := 0; i < count; i++ {
+		pos := rand.Intn(len(result) - 16)
+		edit := make([]byte, 1+rand.Intn(8))
+		rand.Read(edit)
+		switch i % 3 {
+		case 0:
+			copy(result[pos:], edit)
+		case 1:
+			result = append(result[:pos], append(edit, result[pos:]...)...)
+		case 2:
+			result = append(result[:pos], result[pos+len(edit):]...)
+		}
+	}
+	return result
+}
+
+func shareSuperFeature(a Sketch, b Sketch) bool {
+	for _, sfa := range a {
+		for _, sfb := range b {
+			if sfa == sfb {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// detectionRate returns the proportion of mutated chunks that share at least a
+// super-feature with their original chunk, and the proportion of unrelated
+// chunks that do.
+func detectionRate(s Sketcher, chunkSize int, modify func(*rand.Rand, []byte) []byte) (similar float64, unrelated float64) {
+	const count = 200
+	rand := rand.New(rand.NewSource(1))
+	var prev Sketch
+	var similarCount, unrelatedCount int
+	for i := 0; i < count; i++ {
+		chunk := make([]byte, chunkSize)
+		rand.Read(chunk)
+		sk := s.Sketch(chunk)
+		if shareSuperFeature(sk, s.Sketch(modify(rand, chunk))) {
+			similarCount++
+		}
+		if shareSuperFeature(sk, prev) {
+			unrelatedCount++
+		}
+		prev = sk
+	}
+	return float64(similarCount) / count, float64(unrelatedCount) / count
+}
+
+func TestSimilarityDetection(t *testing.T) {
+	pol, err := rabinkarp64.RandomPolynomial(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params := Params{Pol: pol, ChunkSize: 8 << 10, WSize: 32, SfCount: 3, FCount: 4}
+	cases := []struct {
+		name   string
+		modify func(*rand.Rand, []byte) []byte
+		better bool // whole chunk sketchers must detect more similar chunks than region
+	}{
+		{"1 edit", func(r *rand.Rand, c []byte) []byte { return mutate(r, c, 1) }, false},
+		{"16 edits", func(r *rand.Rand, c []byte) []byte { return mutate(r, c, 16) }, false},
+		{"64 edits", func(r *rand.Rand, c []byte) []byte { return mutate(r, c, 64) }, false},
+		{"shift 1k", func(r *rand.Rand, c []byte) []byte { return shift(r, c, 1<<10) }, true},
+		{"shift 4k", func(r *rand.Rand, c []byte) []byte { return shift(r, c, 4<<10) }, false},
+	}
+	for _, c := range cases {
+		rates := make(map[string]float64)
+		for _, name := range sketcherNames {
+			s, err := New(name, params)
+			if err != nil {
+				t.Fatal(err)
+			}
+			similar, unrelated := detectionRate(s, params.ChunkSize, c.modify)
+			t.Logf("%s with %s: %.2f similar, %.2f unrelated", name, c.name, similar, unrelated)
+			if unrelated != 0 {
+				t.Errorf("%s: unrelated chunks should not be detected as similar", name)
+			}
+			rates[name] = similar
+		}
+		for _, name := range []string{TransformName, GearName} {
+			if c.better && rates[name] <= rates[RegionName]+0.5 {
+				t.Errorf("%s: %s should detect much more similar chunks than %s", c.name, name, RegionName)
+			}
+			if rates[name] < rates[RegionName]-0.05 {
+				t.Errorf("%s: %s should detect about as much similar chunks as %s", c.name, name, RegionName)
+			}
+		}
+	}
+	if _, err := New("unknown", params); err == nil {
+		t.Error("an unknown sketcher should return an error")
+	}
+}
+
+func BenchmarkSketchers(b *testing.B) {
+	pol, err := rabinkarp64.RandomPolynomial(1)
+	if err != nil {
+		b.Fatal(err)
+	}
+	params := Params{Pol: pol, ChunkSize: 8 << 10, WSize: 32, SfCount: 3, FCount: 4}
+	chunk := make([]byte, params.ChunkSize)
+	rand.New(rand.NewSource(1)).Read(chunk)
+	for _, name := range sketcherNames {
+		s, _ := New(name, params)
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(int64(len(chunk)))
+			for i := 0; i < b.N; i++ {
+				s.Sketch(chunk)
+			}
+			b.StopTimer()
+			edited, _ := detectionRate(s, params.ChunkSize, func(r *rand.Rand, c []byte) []byte { return mutate(r, c, 16) })
+			shifted, _ := detectionRate(s, params.ChunkSize, func(r *rand.Rand, c []byte) []byte { return shift(r, c, 1<<10) })
+			b.ReportMetric(edited, "edited-similar")
+			b.ReportMetric(shifted, "shifted-similar")
+		})
+	}
+}
@@ -0,0 +1,187 @@
+/* Copyright (C) 2021 Nicolas Peugnet <n.peugnet@free.fr>
+
+   This file is part of dna-backup.
+
+   dna-backup is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   dna-backup is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with dna-backup.  If not, see <https://www.gnu.org/licenses/>. */
+
+package sketch
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+
+	"github.com/chmduquesne/rollinghash/rabinkarp64"
+)
+
+// Names of the available sketchers. As sketches are stored in the hashes of a
+// repo, these names are stored in its config and must never change.
+const (
+	RegionName    = "region"
+	TransformName = "transform"
+	GearName      = "gear"
+)
+
+// Sketcher produces the sketch of a chunk. Two chunks sharing at least one
+// super-feature are considered similar.
+type Sketcher interface {
+	Sketch(chunk []byte) Sketch
+}
+
+// Params are the parameters shared by all the sketchers.
+type Params struct {
+	Pol       rabinkarp64.Pol // polynomial of the rolling hash
+	ChunkSize int             // size of the chunks
+	WSize     int             // size of the rolling hash window
+	SfCount   int             // number of super-features
+	FCount    int             // number of features per super-feature
+}
+
+// New returns the sketcher with the given name.
+func New(name string, p Params) (Sketcher, error) {
+	switch name {
+	case RegionName:
+		return Region{p}, nil
+	case TransformName:
+		return NewTransform(p), nil
+	case GearName:
+		return NewGear(p), nil
+	default:
+		return nil, fmt.Errorf("unknown sketcher: %s", name)
+	}
+}
+
+// Region is the original sketcher of dna-backup. It splits the chunk in fixed
+// size regions and takes the maximum of the rolling hash in each one of them
+// as a feature. It is kept for the repos created with it.
+type Region struct {
+	Params
+}
+
+func (s Region) Sketch(chunk []byte) Sketch {
+	sk, _ := SketchChunk(bytes.NewReader(chunk), s.Pol, s.ChunkSize, s.WSize, s.SfCount, s.FCount)
+	return sk
+}
+
+// Transform follows the super-feature scheme of Shilane et al. (also used by
+// Finesse as its baseline): a single rolling hash is computed over the whole
+// chunk, and each feature is the maximum of a different linear transform
+// (m*h + a) of this hash. Features are then grouped into super-features.
+// Unlike Region, a local change in the chunk only modifies the features whose
+// maximum was in the changed area.
+type Transform struct {
+	Params
+	mul []uint64
+	add []uint64
+}
+
+// NewTransform returns a Transform sketcher. The coefficients of the transforms
+// are fixed so that the sketches of a repo stay the same between runs; they are
+// keyed by the polynomial of the rolling hash.
+func NewTransform(p Params) *Transform {
+	count := p.SfCount * p.FCount
+	rand := rand.New(rand.NewSource(int64(p.Pol)))
+	s := &Transform{
+		Params: p,
+		mul:    make([]uint64, count),
+		add:    make([]uint64, count),
+	}
+	for i := 0; i < count; i++ {
+		s.mul[i] = rand.Uint64() | 1 // odd, so that the transform is a permutation
+		s.add[i] = rand.Uint64()
+	}
+	return s
+}
+
+func (s *Transform) Sketch(chunk []byte) Sketch {
+	if len(chunk) < s.WSize {
+		return Sketch{}
+	}
+	features := make([]uint64, len(s.mul))
+	hasher := rabinkarp64.NewFromPol(s.Pol)
+	hasher.Write(chunk[:s.WSize])
+	s.update(features, hasher.Sum64())
+	for _, b := range chunk[s.WSize:] {
+		hasher.Roll(b)
+		s.update(features, hasher.Sum64())
+	}
+	return superFeatures(s.Pol, features, s.SfCount, s.FCount)
+}
+
+func (s *Transform) update(features []uint64, h uint64) {
+	for i := range features {
+		if t := s.mul[i]*h + s.add[i]; t > features[i] {
+			features[i] = t
+		}
+	}
+}
+
+// Gear is a faster variant of Transform, using the Gear hash of Finesse and
+// FastCDC as rolling hash, which only needs a shift and an addition per byte.
+// Shifting by 2 bits per byte makes its window 32 bytes whatever WSize is, as a
+// wider window is more often touched by edits. Moreover, the transforms are
+// only computed at the positions where the hash matches a mask, which are
+// chosen by the content of the chunk, and thus stay the same when the content
+// is shifted.
+type Gear struct {
+	Transform
+	table [256]uint64
+}
+
+// gearSampleMask selects one position every 8 bytes on average.
+const gearSampleMask = 0x7 << 61
+
+// NewGear returns a Gear sketcher. Its table is keyed by the polynomial, like
+// the coefficients of the transforms.
+func NewGear(p Params) *Gear {
+	s := &Gear{Transform: *NewTransform(p)}
+	rand := rand.New(rand.NewSource(^int64(p.Pol)))
+	for i := range s.table {
+		s.table[i] = rand.Uint64()
+	}
+	return s
+}
+
+func (s *Gear) Sketch(chunk []byte) Sketch {
+	if len(chunk) < s.WSize {
+		return Sketch{}
+	}
+	features := make([]uint64, len(s.mul))
+	var h uint64
+	for _, b := range chunk {
+		h = h<<2 + s.table[b]
+		if h&gearSampleMask == 0 {
+			s.update(features, h)
+		}
+	}
+	return superFeatures(s.Pol, features, s.SfCount, s.FCount)
+}
+
+// superFeatures groups the given features into super-features by hashing each
+// group of fCount of them.
+func superFeatures(pol rabinkarp64.Pol, features []uint64, sfCount int, fCount int) Sketch {
+	superfeatures := make(Sketch, 0, sfCount)
+	sfBuff := make([]byte, fBytes*fCount)
+	hasher := rabinkarp64.NewFromPol(pol)
+	for sf := 0; sf < len(features)/fCount; sf++ {
+		for i := 0; i < fCount; i++ {
+			binary.LittleEndian.PutUint64(sfBuff[i*fBytes:(i+1)*fBytes], features[i+sf*fCount])
+		}
+		hasher.Reset()
+		hasher.Write(sfBuff)
+		superfeatures = append(superfeatures, hasher.Sum64())
+	}
+	return superfeatures
+}
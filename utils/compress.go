@@ -0,0 +1,196 @@
+/* Copyright (C) 2021 Nicolas Peugnet <n.peugnet@free.fr>
+
+   This file is part of dna-backup.
+
+   dna-backup is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   dna-backup is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with dna-backup.  If not, see <https://www.gnu.org/licenses/>. */
+
+package utils
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+const (
+	CompressionNone = "none"
+	CompressionZlib = "zlib"
+	CompressionZstd = "zstd"
+	CompressionXz   = "xz"
+)
+
+// The ID of a compression algorithm is stored in front of the data it has
+// compressed, so that data compressed with different algorithms can be read.
+// These values must never change.
+const (
+	CompressionNoneId byte = iota + 1
+	CompressionZlibId
+	CompressionZstdId
+	CompressionXzId
+)
+
+var compressionIds = map[string]byte{
+	CompressionNone: CompressionNoneId,
+	CompressionZlib: CompressionZlibId,
+	CompressionZstd: CompressionZstdId,
+	CompressionXz:   CompressionXzId,
+}
+
+// CompressionId returns the ID of the compression algorithm with the given name.
+func CompressionId(name string) (byte, error) {
+	id, exists := compressionIds[name]
+	if !exists {
+		return 0, fmt.Errorf("unknown compression algorithm %q", name)
+	}
+	return id, nil
+}
+
+// CompressionName returns the name of the compression algorithm with the given
+// ID.
+func CompressionName(id byte) (string, error) {
+	for name, i := range compressionIds {
+		if i == id {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("unknown compression algorithm id %d", id)
+}
+
+// Compression returns the wrappers of the compression algorithm with the given
+// name. The level is only used by zstd, 0 meaning its default level.
+func Compression(name string, level int) (ReadWrapper, WriteWrapper, error) {
+	switch name {
+	case CompressionNone:
+		return NopReadWrapper, NopWriteWrapper, nil
+	case CompressionZlib:
+		return ZlibReader, ZlibWriter, nil
+	case CompressionZstd:
+		if level == 0 {
+			return ZstdReader, ZstdWriter, nil
+		}
+		return ZstdReader, ZstdLevelWriter(level), nil
+	case CompressionXz:
+		return XzReader, XzWriter, nil
+	}
+	return nil, nil, fmt.Errorf("unknown compression algorithm %q", name)
+}
+
+// ZstdReader wraps a reader with a new zstd.Decoder.
+func ZstdReader(r io.Reader) (io.ReadCloser, error) {
+	d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	return d.IOReadCloser(), nil
+}
+
+// ZstdWriter wraps a writer with a new zstd.Encoder using the default level (3).
+func ZstdWriter(w io.Writer) io.WriteCloser {
+	return ZstdLevelWriter(3)(w)
+}
+
+// ZstdLevelWriter returns a wrapper that wraps a writer with a new zstd.Encoder
+// using the given level, which follows the levels of the zstd command (1-22).
+func ZstdLevelWriter(level int) WriteWrapper {
+	return func(w io.Writer) io.WriteCloser {
+		e, err := zstd.NewWriter(w,
+			zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)),
+			zstd.WithEncoderConcurrency(1),
+		)
+		if err != nil {
+			panic(err)
+		}
+		return e
+	}
+}
+
+// ZstdDictReader returns a wrapper that wraps a reader with a new zstd.Decoder
+// that can use the given dictionaries. The one used by each frame is found
+// using the dictionary ID stored in its header.
+func ZstdDictReader(dicts ...[]byte) ReadWrapper {
+	return func(r io.Reader) (io.ReadCloser, error) {
+		d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1), zstd.WithDecoderDicts(dicts...))
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	}
+}
+
+// ZstdDictWriter returns a wrapper that wraps a writer with a new zstd.Encoder
+// using the given level (0 being the default) and dictionary.
+func ZstdDictWriter(level int, dict []byte) WriteWrapper {
+	if level == 0 {
+		level = 3
+	}
+	return func(w io.Writer) io.WriteCloser {
+		e, err := zstd.NewWriter(w,
+			zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)),
+			zstd.WithEncoderConcurrency(1),
+			zstd.WithEncoderDict(dict),
+		)
+		if err != nil {
+			panic(err)
+		}
+		return e
+	}
+}
+
+// TrainZstdDict builds a zstd dictionary with the given ID from samples of the
+// data that will be compressed with it. Its content is made of the first
+// samples, up to the given size.
+func TrainZstdDict(id uint32, samples [][]byte, size int) (dict []byte, err error) {
+	// BuildDict panics when the samples do not contain enough sequences
+	defer func() {
+		if e := recover(); e != nil {
+			dict, err = nil, fmt.Errorf("zstd dictionary training failed: %v", e)
+		}
+	}()
+	history := make([]byte, 0, size)
+	for _, s := range samples {
+		if len(history)+len(s) > size {
+			s = s[:size-len(history)]
+		}
+		history = append(history, s...)
+		if len(history) == size {
+			break
+		}
+	}
+	return zstd.BuildDict(zstd.BuildDictOptions{
+		ID:       id,
+		Contents: samples,
+		History:  history,
+		Offsets:  [3]int{1, 4, 8},
+	})
+}
+
+// XzReader wraps a reader with a new xz.Reader.
+func XzReader(r io.Reader) (io.ReadCloser, error) {
+	x, err := xz.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(x), nil
+}
+
+// XzWriter wraps a writer with a new xz.Writer.
+func XzWriter(w io.Writer) io.WriteCloser {
+	x, err := xz.NewWriter(w)
+	if err != nil {
+		panic(err)
+	}
+	return x
+}
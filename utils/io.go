@@ -18,6 +18,7 @@
 package utils
 
 import (
+	"bytes"
 	"compress/zlib"
 	"io"
 )
@@ -55,6 +56,67 @@ func NopWriteWrapper(w io.Writer) io.WriteCloser {
 	return NopCloser(w)
 }
 
+// ChainReadWrappers returns a ReadWrapper that applies each given wrapper in
+// order, the first one reading directly from the wrapped reader.
+// Closing the returned reader closes every layer.
+func ChainReadWrappers(wrappers ...ReadWrapper) ReadWrapper {
+	return func(r io.Reader) (io.ReadCloser, error) {
+		layers := make([]io.ReadCloser, 0, len(wrappers))
+		for _, wrapper := range wrappers {
+			rc, err := wrapper(r)
+			if err != nil {
+				return nil, err
+			}
+			layers = append(layers, rc)
+			r = rc
+		}
+		return &chainReadCloser{r, layers}, nil
+	}
+}
+
+type chainReadCloser struct {
+	io.Reader
+	layers []io.ReadCloser
+}
+
+func (c *chainReadCloser) Close() (err error) {
+	for i := len(c.layers) - 1; i >= 0; i-- {
+		if e := c.layers[i].Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return
+}
+
+// ChainWriteWrappers returns a WriteWrapper that applies each given wrapper in
+// order, the first one writing directly into the wrapped writer.
+// Closing the returned writer closes every layer, the last one first.
+func ChainWriteWrappers(wrappers ...WriteWrapper) WriteWrapper {
+	return func(w io.Writer) io.WriteCloser {
+		layers := make([]io.WriteCloser, 0, len(wrappers))
+		for _, wrapper := range wrappers {
+			wc := wrapper(w)
+			layers = append(layers, wc)
+			w = wc
+		}
+		return &chainWriteCloser{w, layers}
+	}
+}
+
+type chainWriteCloser struct {
+	io.Writer
+	layers []io.WriteCloser
+}
+
+func (c *chainWriteCloser) Close() (err error) {
+	for i := len(c.layers) - 1; i >= 0; i-- {
+		if e := c.layers[i].Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return
+}
+
 type WriteCounter struct {
 	w     io.Writer
 	count int
@@ -73,3 +135,54 @@ func (c *WriteCounter) Write(p []byte) (n int, err error) {
 func (c *WriteCounter) Count() int {
 	return c.count
 }
+
+// TagWriter returns a WriteWrapper that writes the given tag in front of the
+// data written by the given wrapper.
+func TagWriter(tag byte, wrapper WriteWrapper) WriteWrapper {
+	return func(w io.Writer) io.WriteCloser {
+		return wrapper(&tagWriter{w: w, tag: tag})
+	}
+}
+
+// tagWriter writes its tag just before the first data written to it.
+type tagWriter struct {
+	w       io.Writer
+	tag     byte
+	written bool
+}
+
+func (t *tagWriter) Write(p []byte) (n int, err error) {
+	if !t.written {
+		if _, err = t.w.Write([]byte{t.tag}); err != nil {
+			return 0, err
+		}
+		t.written = true
+	}
+	return t.w.Write(p)
+}
+
+// TagReader returns a ReadWrapper that reads the tag written by a TagWriter and
+// wraps the rest of the data with the wrapper returned by lookup for this tag.
+// Empty data is read as is.
+//
+// If lookup fails and untagged is not nil, the data is considered to have been
+// written without tag, and is wrapped as a whole, first byte included, by
+// untagged.
+func TagReader(lookup func(tag byte) (ReadWrapper, error), untagged ReadWrapper) ReadWrapper {
+	return func(r io.Reader) (io.ReadCloser, error) {
+		var tag [1]byte
+		if _, err := io.ReadFull(r, tag[:]); err == io.EOF {
+			return io.NopCloser(r), nil
+		} else if err != nil {
+			return nil, err
+		}
+		wrapper, err := lookup(tag[0])
+		if err != nil {
+			if untagged == nil {
+				return nil, err
+			}
+			return untagged(io.MultiReader(bytes.NewReader(tag[:]), r))
+		}
+		return wrapper(r)
+	}
+}
@@ -19,7 +19,9 @@ package utils_test
 
 import (
 	"bytes"
+	"fmt"
 	"io"
+	"strings"
 	"testing"
 
 	"github.com/n-peugnet/dna-backup/utils"
@@ -38,6 +40,14 @@ func TestNopCloser(t *testing.T) {
 	}
 }
 
+func xzTagLookup(tag byte) (utils.ReadWrapper, error) {
+	read, _, err := utils.Compression(utils.CompressionXz, 0)
+	if tag != utils.CompressionXzId {
+		return nil, fmt.Errorf("wrong tag %d", tag)
+	}
+	return read, err
+}
+
 type wrapper struct {
 	n string
 	r utils.ReadWrapper
@@ -48,6 +58,21 @@ func TestWrappers(t *testing.T) {
 	wrappers := []wrapper{
 		{"Zlib", utils.ZlibReader, utils.ZlibWriter},
 		{"Nop", utils.NopReadWrapper, utils.NopWriteWrapper},
+		{"Zstd", utils.ZstdReader, utils.ZstdWriter},
+		{"Zstd19", utils.ZstdReader, utils.ZstdLevelWriter(19)},
+		{"Xz", utils.XzReader, utils.XzWriter},
+		{"Chain",
+			utils.ChainReadWrappers(utils.ZlibReader, utils.ZlibReader),
+			utils.ChainWriteWrappers(utils.ZlibWriter, utils.ZlibWriter),
+		},
+		{"Tag",
+			utils.TagReader(xzTagLookup, nil),
+			utils.TagWriter(utils.CompressionXzId, utils.XzWriter),
+		},
+		{"Untagged",
+			utils.TagReader(xzTagLookup, utils.ZlibReader),
+			utils.ZlibWriter,
+		},
 	}
 	for _, wrapper := range wrappers {
 		t.Run(wrapper.n, func(t *testing.T) {
@@ -91,3 +116,32 @@ func testWrapper(t *testing.T, wrapper wrapper) {
 		t.Error(wrapper.n, err)
 	}
 }
+
+func TestZstdDict(t *testing.T) {
+	var samples [][]byte
+	words := []string{"error", "warning", "info", "debug", "request", "response", "user", "server"}
+	for i := 0; i < 64; i++ {
+		var sb strings.Builder
+		for j := 0; j < 256; j++ {
+			fmt.Fprintf(&sb, "%d-%02d %s: %s %d took %dms\n", i, j%60, words[(i+j)%len(words)], words[(i*j)%len(words)], i*j*7919%100003, (i+j*31)%997)
+		}
+		samples = append(samples, []byte(sb.String()))
+	}
+	dict, err := utils.TrainZstdDict(32768, samples, 4<<10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testWrapper(t, wrapper{"ZstdDict", utils.ZstdDictReader(dict), utils.ZstdDictWriter(0, dict)})
+
+	var buff bytes.Buffer
+	w := utils.ZstdDictWriter(0, dict)(&buff)
+	w.Write([]byte("test"))
+	w.Close()
+	r, err := utils.ZstdReader(&buff)
+	if err == nil {
+		_, err = io.ReadAll(r)
+	}
+	if err == nil {
+		t.Error("data compressed with a dictionary should not be readable without it")
+	}
+}